@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Overridden in tests so we can fake up the kernel's view of the world
+var sysfsRoot = "/sys"
+var devRoot = "/dev"
+
+func readSysfsString(path string) (string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(sysfsRoot, path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func sysfsExists(path string) bool {
+	_, err := os.Stat(filepath.Join(sysfsRoot, path))
+	return err == nil
+}
+
+func isPartition(name string) bool {
+	return sysfsExists(filepath.Join("class/block", name, "partition"))
+}
+
+// Returns the kernel name of the disk a block device lives on,
+// which is just the name itself if it isn't a partition.
+func diskForBlockDevice(name string) (string, error) {
+	if !isPartition(name) {
+		return name, nil
+	}
+	realPath, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class/block", name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(filepath.Dir(realPath)), nil
+}
+
+// The first sector of a partition, or 0 for a whole disk
+func partitionStart(name string) int64 {
+	start, err := readSysfsString(filepath.Join("class/block", name, "start"))
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.ParseInt(start, 10, 64)
+	return value
+}
+
+func listPartitions(disk string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "block", disk))
+	if err != nil {
+		return []string{}
+	}
+	partitions := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), disk) && isPartition(entry.Name()) {
+			partitions = append(partitions, entry.Name())
+		}
+	}
+	sort.Strings(partitions)
+	return partitions
+}
+
+func isXenInstance() bool {
+	hypervisor, err := readSysfsString("hypervisor/type")
+	return err == nil && hypervisor == "xen"
+}
+
+// Decodes a dev_t the same way glibc's major() and minor() do
+func splitDeviceNumber(dev uint64) (uint32, uint32) {
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
+
+// Returns the major:minor of the filesystem holding a path, which sees
+// through bind mounts because it comes from the inode.
+func deviceNumberForPath(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", err
+	}
+	major, minor := splitDeviceNumber(uint64(stat.Dev))
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+func deviceNameForNumber(number string) (string, error) {
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "dev/block", number))
+	if err != nil {
+		return "", fmt.Errorf("%s isn't a block device", number)
+	}
+	return filepath.Base(devicePath), nil
+}
+
+// Mount sources are whatever was given to mount, like /dev/mapper/vg-build,
+// which is a symlink to the kernel name (dm-0) that sysfs goes by.
+func kernelNameForSource(source string) string {
+	if strings.HasPrefix(source, "/dev/") {
+		if realPath, err := filepath.EvalSymlinks(filepath.Join(devRoot, strings.TrimPrefix(source, "/dev/"))); err == nil {
+			return filepath.Base(realPath)
+		}
+	}
+	return filepath.Base(source)
+}
+
+// The device mapper names its devices dm-N, but everyone else (and every
+// tool we run) knows them by their /dev/mapper name.
+func devicePath(name string) string {
+	if dmName, err := readSysfsString(filepath.Join("class/block", name, "dm/name")); err == nil {
+		return "/dev/mapper/" + dmName
+	}
+	return "/dev/" + name
+}
+
+// The devices directly underneath a stacked device (dm, md, ...)
+func slaveDevices(name string) []string {
+	if isMdDevice(name) {
+		return mdMembers(name)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "class/block", name, "slaves"))
+	if err != nil {
+		return []string{}
+	}
+	slaves := []string{}
+	for _, entry := range entries {
+		slaves = append(slaves, entry.Name())
+	}
+	return slaves
+}
+
+// Follows the slaves all the way down to the partitions and disks at the
+// bottom of the stack.
+func leafDevices(name string) []string {
+	slaves := slaveDevices(name)
+	if len(slaves) == 0 {
+		return []string{name}
+	}
+	leaves := []string{}
+	for _, slave := range slaves {
+		leaves = append(leaves, leafDevices(slave)...)
+	}
+	return leaves
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func useFakeSysfs(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "resize-thyself-sysfs")
+	assert.NilError(t, err)
+	oldSysfsRoot, oldDevRoot := sysfsRoot, devRoot
+	sysfsRoot = filepath.Join(dir, "sys")
+	devRoot = filepath.Join(dir, "dev")
+	return func() {
+		sysfsRoot, devRoot = oldSysfsRoot, oldDevRoot
+		os.RemoveAll(dir)
+	}
+}
+
+func writeSysfsFile(t *testing.T, path string, contents string) {
+	fullPath := filepath.Join(sysfsRoot, path)
+	assert.NilError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+	assert.NilError(t, ioutil.WriteFile(fullPath, []byte(contents+"\n"), 0644))
+}
+
+// Lays out a disk (and its partitions) the way the kernel does, with the
+// real directories under devices/ and symlinks from block/ and class/block/
+func addFakeDisk(t *testing.T, disk string, partitions ...string) {
+	diskPath := filepath.Join("devices/virtual/block", disk)
+	writeSysfsFile(t, filepath.Join(diskPath, "size"), "2097152")
+	for _, name := range []string{"block", "class/block"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(sysfsRoot, name), 0755))
+	}
+	assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, diskPath), filepath.Join(sysfsRoot, "block", disk)))
+	assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, diskPath), filepath.Join(sysfsRoot, "class/block", disk)))
+	for i, partition := range partitions {
+		partitionPath := filepath.Join(diskPath, partition)
+		writeSysfsFile(t, filepath.Join(partitionPath, "partition"), string(rune('1'+i)))
+		assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, partitionPath), filepath.Join(sysfsRoot, "class/block", partition)))
+	}
+}
+
+func TestDiskForBlockDevice(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme0n1", "nvme0n1p1", "nvme0n1p2")
+	addFakeDisk(t, "nvme1n1")
+
+	disk, err := diskForBlockDevice("nvme0n1p2")
+	assert.NilError(t, err)
+	assert.Equal(t, disk, "nvme0n1")
+
+	disk, err = diskForBlockDevice("nvme1n1")
+	assert.NilError(t, err)
+	assert.Equal(t, disk, "nvme1n1")
+
+	assert.DeepEqual(t, listPartitions("nvme0n1"), []string{"nvme0n1p1", "nvme0n1p2"})
+	assert.DeepEqual(t, listPartitions("nvme1n1"), []string{})
+}
+
+func TestSplitDeviceNumber(t *testing.T) {
+	major, minor := splitDeviceNumber(0x10301)
+	assert.Equal(t, major, uint32(259))
+	assert.Equal(t, minor, uint32(1))
+
+	major, minor = splitDeviceNumber(0x10ca04)
+	assert.Equal(t, major, uint32(202))
+	assert.Equal(t, minor, uint32(256+4))
+}
+
+func addFakeDeviceNumber(t *testing.T, name string, number string) {
+	writeSysfsFile(t, filepath.Join("class/block", name, "dev"), number)
+	assert.NilError(t, os.MkdirAll(filepath.Join(sysfsRoot, "dev/block"), 0755))
+	assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, "class/block", name), filepath.Join(sysfsRoot, "dev/block", number)))
+}
+
+// Lays out a device mapper device stacked on top of the given slaves
+func addFakeDmDevice(t *testing.T, name string, dmName string, uuid string, slaves ...string) {
+	addFakeDisk(t, name)
+	writeSysfsFile(t, filepath.Join("class/block", name, "dm/name"), dmName)
+	writeSysfsFile(t, filepath.Join("class/block", name, "dm/uuid"), uuid)
+	assert.NilError(t, os.MkdirAll(filepath.Join(sysfsRoot, "class/block", name, "slaves"), 0755))
+	for _, slave := range slaves {
+		assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, "class/block", slave), filepath.Join(sysfsRoot, "class/block", name, "slaves", slave)))
+	}
+}
+
+func TestLeafDevices(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1")
+	addFakeDisk(t, "nvme2n1")
+	addFakeDmDevice(t, "dm-0", "vg-data", "LVM-abc", "nvme1n1p1", "nvme2n1")
+
+	assert.DeepEqual(t, leafDevices("dm-0"), []string{"nvme1n1p1", "nvme2n1"})
+	assert.DeepEqual(t, leafDevices("nvme1n1p1"), []string{"nvme1n1p1"})
+	assert.Equal(t, devicePath("dm-0"), "/dev/mapper/vg-data")
+	assert.Equal(t, devicePath("nvme2n1"), "/dev/nvme2n1")
+	assert.Equal(t, isLvmDevice("dm-0"), true)
+	assert.Equal(t, isLvmDevice("nvme2n1"), false)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Btrfs allocates metadata chunks of up to 1GiB (times the metadata
+// ratio, for DUP and RAID1), so that much has to be unallocated for
+// metadata to keep growing.
+const btrfsMetadataChunkSize = 1 << 30
+
+type btrfsUsage struct {
+	DeviceSize        uint64
+	DeviceUnallocated uint64
+	FreeEstimated     uint64
+	DataRatio         float64
+	MetadataRatio     float64
+	MetadataSize      uint64
+	MetadataUsed      uint64
+}
+
+// How full the data side is, as a fraction of what could ever be stored
+func (u btrfsUsage) DataUsedFraction() float64 {
+	capacity := float64(u.DeviceSize) / u.DataRatio
+	return 1 - float64(u.FreeEstimated)/capacity
+}
+
+func (u btrfsUsage) MetadataUsedFraction() float64 {
+	if u.MetadataSize == 0 {
+		return 0
+	}
+	return float64(u.MetadataUsed) / float64(u.MetadataSize)
+}
+
+func (u btrfsUsage) CanAllocateMetadataChunk() bool {
+	return float64(u.DeviceUnallocated) >= u.MetadataRatio*btrfsMetadataChunkSize
+}
+
+func parseBtrfsKeyValue(line string) (string, string) {
+	split := strings.SplitN(line, ":", 2)
+	if len(split) != 2 {
+		return "", ""
+	}
+	value := strings.Fields(split[1])
+	if len(value) == 0 {
+		return strings.TrimSpace(split[0]), ""
+	}
+	return strings.TrimSpace(split[0]), value[0]
+}
+
+// Parses the output of `btrfs filesystem usage -b <mount>`
+func parseBtrfsUsage(output string) (btrfsUsage, error) {
+	usage := btrfsUsage{DataRatio: 1, MetadataRatio: 1}
+	var err error
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Metadata,") {
+			for _, field := range strings.Fields(strings.Replace(line, ",", " ", -1)) {
+				if strings.HasPrefix(field, "Size:") {
+					usage.MetadataSize, err = strconv.ParseUint(strings.TrimPrefix(field, "Size:"), 10, 64)
+				} else if strings.HasPrefix(field, "Used:") {
+					usage.MetadataUsed, err = strconv.ParseUint(strings.TrimPrefix(field, "Used:"), 10, 64)
+				}
+				if err != nil {
+					return usage, fmt.Errorf("couldn't parse btrfs metadata usage %q: %v", line, err)
+				}
+			}
+			continue
+		}
+		key, value := parseBtrfsKeyValue(line)
+		switch key {
+		case "Device size":
+			usage.DeviceSize, err = strconv.ParseUint(value, 10, 64)
+		case "Device unallocated":
+			usage.DeviceUnallocated, err = strconv.ParseUint(value, 10, 64)
+		case "Free (estimated)":
+			usage.FreeEstimated, err = strconv.ParseUint(value, 10, 64)
+		case "Data ratio":
+			usage.DataRatio, err = strconv.ParseFloat(value, 64)
+		case "Metadata ratio":
+			usage.MetadataRatio, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return usage, fmt.Errorf("couldn't parse btrfs usage %q: %v", line, err)
+		}
+	}
+	if usage.DeviceSize == 0 || usage.DataRatio == 0 {
+		return usage, fmt.Errorf("couldn't find the device size in btrfs usage output:\n%s", output)
+	}
+	return usage, nil
+}
+
+// Parses the devid to device path mapping out of `btrfs filesystem show --raw`
+func parseBtrfsDevids(output string) map[string]string {
+	devids := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "devid" {
+			continue
+		}
+		for i, field := range fields {
+			if field == "path" && i+1 < len(fields) {
+				devids[fields[i+1]] = fields[1]
+			}
+		}
+	}
+	return devids
+}
+
+// Lists the kernel names of every device in the btrfs filesystem that
+// the given device belongs to.
+func btrfsMemberDevices(device string) []string {
+	matches, _ := filepath.Glob(filepath.Join(sysfsRoot, "fs/btrfs/*/devices", device))
+	if len(matches) == 0 {
+		return []string{}
+	}
+	members, _ := filepath.Glob(filepath.Join(filepath.Dir(matches[0]), "*"))
+	for i, member := range members {
+		members[i] = filepath.Base(member)
+	}
+	return members
+}
+
+func btrfsUsageOf(mount string) btrfsUsage {
+	usage, err := parseBtrfsUsage(safeRun([]string{"btrfs", "filesystem", "usage", "-b", mount}, false))
+	if err != nil {
+		log.Panic(err)
+	}
+	return usage
+}
+
+// Unlike df, this takes into account that data and metadata chunks fill
+// up independently, so running out of room for metadata also counts.
+func btrfsNeedsResizing(mount string, thresholds usageThresholds) (bool, float64) {
+	return checkBtrfsThresholds(mount, btrfsUsageOf(mount), thresholds)
+}
+
+func checkBtrfsThresholds(mount string, usage btrfsUsage, thresholds usageThresholds) (bool, float64) {
+	capacity := uint64(float64(usage.DeviceSize) / usage.DataRatio)
+	needsResizing, growPercent := checkSpaceThresholds(mount, usage.DataUsedFraction(), usage.FreeEstimated, capacity, thresholds)
+	log.Printf("%s has a btrfs metadata usage of %.2f%%", mount, usage.MetadataUsedFraction()*100)
+	if usage.MetadataUsedFraction() > thresholds.Used && !usage.CanAllocateMetadataChunk() {
+		log.Printf("%s is running out of metadata space and there isn't room to allocate another metadata chunk", mount)
+		needsResizing = true
+	}
+	return needsResizing, growPercent
+}
+
+// Grows each of the given devices to fill its (newly grown) partition or
+// disk. Btrfs wants a devid for this, which we look up by device path.
+// The devices are kernel names of whatever is at the top of each storage
+// stack, since that's what btrfs sits on.
+func resizeBtrfsFilesystem(mount string, devices []string, dryRun bool) {
+	devids := parseBtrfsDevids(safeRun([]string{"btrfs", "filesystem", "show", "--raw", mount}, false))
+	found, err := btrfsDevidsFor(mount, devids, devices)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, devid := range found {
+		safeRun([]string{"btrfs", "filesystem", "resize", devid + ":max", mount}, dryRun)
+	}
+}
+
+func btrfsDevidsFor(mount string, devids map[string]string, devices []string) ([]string, error) {
+	found := []string{}
+	for _, device := range devices {
+		devid, ok := devids[devicePath(device)]
+		if !ok {
+			return nil, fmt.Errorf("%s doesn't seem to be part of the btrfs filesystem on %s: %v", devicePath(device), mount, devids)
+		}
+		found = append(found, devid)
+	}
+	return found, nil
+}
+
+func addBtrfsDevice(mount string, device string, dryRun bool) {
+	log.Printf("Adding %s to the btrfs filesystem at %s\n", device, mount)
+	safeRun([]string{"btrfs", "device", "add", device, mount}, dryRun)
+}
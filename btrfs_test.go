@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testBtrfsUsage = `Overall:
+    Device size:                 21474836480
+    Device allocated:             4345298944
+    Device unallocated:          17129537536
+    Device missing:                        0
+    Used:                         1180696576
+    Free (estimated):            19326713856	(min: 10762944512)
+    Free (statfs, df):           19325665280
+    Data ratio:                         1.00
+    Metadata ratio:                     2.00
+    Global reserve:                  3407872	(used: 0)
+    Multiple profiles:                    no
+
+Data,single: Size:3221225472, Used:1074053120 (33.34%)
+   /dev/nvme1n1	3221225472
+
+Metadata,DUP: Size:536870912, Used:53305344 (9.93%)
+   /dev/nvme1n1	1073741824
+
+System,DUP: Size:8388608, Used:16384 (0.20%)
+   /dev/nvme1n1	16777216
+
+Unallocated:
+   /dev/nvme1n1	17129537536
+`
+
+func TestParseBtrfsUsage(t *testing.T) {
+	usage, err := parseBtrfsUsage(testBtrfsUsage)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, usage, btrfsUsage{
+		DeviceSize:        21474836480,
+		DeviceUnallocated: 17129537536,
+		FreeEstimated:     19326713856,
+		DataRatio:         1,
+		MetadataRatio:     2,
+		MetadataSize:      536870912,
+		MetadataUsed:      53305344,
+	})
+	assert.Assert(t, usage.DataUsedFraction() > 0.09 && usage.DataUsedFraction() < 0.11)
+	assert.Assert(t, usage.MetadataUsedFraction() > 0.09 && usage.MetadataUsedFraction() < 0.11)
+	assert.Equal(t, usage.CanAllocateMetadataChunk(), true)
+
+	usage.DeviceUnallocated = 1 << 30
+	assert.Equal(t, usage.CanAllocateMetadataChunk(), false)
+
+	_, err = parseBtrfsUsage("Overall:\n")
+	assert.ErrorContains(t, err, "couldn't find the device size")
+}
+
+func TestCheckBtrfsThresholds(t *testing.T) {
+	usage, err := parseBtrfsUsage(testBtrfsUsage)
+	assert.NilError(t, err)
+	// About 18GiB free of 20GiB, which is fine by percent but not with 50GiB
+	thresholds := usageThresholds{Used: 0.9, MinFree: 50 << 30, Trigger: "any"}
+	needsResizing, growPercent := checkBtrfsThresholds("/data", usage, thresholds)
+	assert.Equal(t, needsResizing, true)
+	assert.Equal(t, growPercent, float64(50<<30-19326713856)/21474836480)
+
+	thresholds.Trigger = "all"
+	needsResizing, _ = checkBtrfsThresholds("/data", usage, thresholds)
+	assert.Equal(t, needsResizing, false)
+
+	// Out of room for metadata counts whatever the trigger
+	usage.MetadataUsed = usage.MetadataSize
+	usage.DeviceUnallocated = 0
+	needsResizing, _ = checkBtrfsThresholds("/data", usage, thresholds)
+	assert.Equal(t, needsResizing, true)
+}
+
+func TestParseBtrfsDevids(t *testing.T) {
+	show := `Label: 'build'  uuid: 8a3c4e2a-3b0f-4c7e-9d56-2f0f8c1d9b11
+	Total devices 2 FS bytes used 1180696576
+	devid    1 size 10737418240 used 4345298944 path /dev/nvme1n1
+	devid    2 size 10737418240 used 0 path /dev/nvme2n1p1
+
+`
+	assert.DeepEqual(t, parseBtrfsDevids(show), map[string]string{
+		"/dev/nvme1n1":   "1",
+		"/dev/nvme2n1p1": "2",
+	})
+}
+
+func TestBtrfsDevidsFor(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1")
+	addFakeDmDevice(t, "dm-0", "vg-build", "LVM-abc", "nvme1n1p1")
+	devids := map[string]string{"/dev/mapper/vg-build": "1", "/dev/nvme2n1": "2"}
+
+	found, err := btrfsDevidsFor("/build", devids, []string{"dm-0"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, found, []string{"1"})
+	_, err = btrfsDevidsFor("/build", devids, []string{"nvme1n1p1"})
+	assert.ErrorContains(t, err, "/dev/nvme1n1p1 doesn't seem to be part of the btrfs filesystem on /build")
+}
+
+func TestBtrfsMemberDevices(t *testing.T) {
+	defer useFakeSysfs(t)()
+	devices := filepath.Join(sysfsRoot, "fs/btrfs/8a3c4e2a-3b0f-4c7e-9d56-2f0f8c1d9b11/devices")
+	assert.NilError(t, os.MkdirAll(devices, 0755))
+	for _, name := range []string{"nvme1n1", "nvme2n1p1"} {
+		assert.NilError(t, os.Symlink(filepath.Join("../../../../block", name), filepath.Join(devices, name)))
+	}
+	assert.DeepEqual(t, btrfsMemberDevices("nvme2n1p1"), []string{"nvme1n1", "nvme2n1p1"})
+	assert.DeepEqual(t, btrfsMemberDevices("nvme3n1"), []string{})
+}
+
+func TestFilesystemDevicesBtrfsOnLvm(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1")
+	addFakeDmDevice(t, "dm-0", "vg-build", "LVM-abc", "nvme1n1")
+	devices := filepath.Join(sysfsRoot, "fs/btrfs/8a3c4e2a-3b0f-4c7e-9d56-2f0f8c1d9b11/devices")
+	assert.NilError(t, os.MkdirAll(devices, 0755))
+	assert.NilError(t, os.Symlink("../../../../block/dm-0", filepath.Join(devices, "dm-0")))
+	// udev's /dev/mapper names are symlinks to the kernel's dm-N ones
+	assert.NilError(t, os.MkdirAll(filepath.Join(devRoot, "mapper"), 0755))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(devRoot, "dm-0"), nil, 0644))
+	assert.NilError(t, os.Symlink("../dm-0", filepath.Join(devRoot, "mapper/vg-build")))
+
+	mount := mountInfo{MountPoint: "/build", FSType: "btrfs", Source: "/dev/mapper/vg-build"}
+	assert.DeepEqual(t, filesystemDevices(mount), []string{"dm-0"})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+func isCryptDevice(name string) bool {
+	uuid, err := readSysfsString(filepath.Join("class/block", name, "dm/uuid"))
+	return err == nil && strings.HasPrefix(uuid, "CRYPT-")
+}
+
+// Pulls the key location out of `cryptsetup status`, which is "keyring"
+// or "dm-crypt". Older cryptsetups that don't print it can't put the key
+// in the keyring either.
+func parseCryptKeyLocation(status string) string {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(fields) == 2 && fields[0] == "key location" {
+			return strings.TrimSpace(fields[1])
+		}
+	}
+	return "dm-crypt"
+}
+
+// LUKS2 keeps the volume key in the kernel keyring rather than the dm
+// table, and then cryptsetup needs the passphrase (or a keyfile) to resize.
+// A key in the table itself means cryptsetup can resize on its own.
+func isCryptKeyInKeyring(location string) bool {
+	return location == "keyring"
+}
+
+// Swapped out in tests
+var cryptsetupStatus = func(mapping string) string {
+	return safeRun([]string{"cryptsetup", "status", mapping}, false)
+}
+
+func cryptMappingName(name string) string {
+	dmName, _ := readSysfsString(filepath.Join("class/block", name, "dm/name"))
+	return dmName
+}
+
+// Checks up front that we'll be able to resize the crypt device, so we
+// don't grow the EBS volume only to find out we need a passphrase.
+func checkCryptResizable(name string, keyFile string) error {
+	mapping := cryptMappingName(name)
+	if isCryptKeyInKeyring(parseCryptKeyLocation(cryptsetupStatus(mapping))) && keyFile == "" {
+		return fmt.Errorf("%s keeps its volume key in the kernel keyring, so resizing it needs a passphrase; pass --crypt-keyfile to use a keyfile instead", mapping)
+	}
+	return nil
+}
+
+func cryptsetupResizeCommand(mapping string, keyFile string) []string {
+	if keyFile != "" {
+		return []string{"cryptsetup", "resize", "--key-file", keyFile, mapping}
+	}
+	return []string{"cryptsetup", "resize", mapping}
+}
+
+func resizeCryptDevice(name string, keyFile string, dryRun bool) {
+	mapping := cryptMappingName(name)
+	log.Printf("Resizing dm-crypt mapping %s\n", mapping)
+	safeRun(cryptsetupResizeCommand(mapping, keyFile), dryRun)
+}
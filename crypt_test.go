@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testCryptStatusLuks2 = `/dev/mapper/crypt-data is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  device:  /dev/nvme1n1p1
+  sector size:  512
+  offset:  32768 sectors
+  size:    20967424 sectors
+  mode:    read/write
+`
+
+func TestParseCryptKeyLocation(t *testing.T) {
+	assert.Equal(t, parseCryptKeyLocation(testCryptStatusLuks2), "keyring")
+	assert.Equal(t, isCryptKeyInKeyring(parseCryptKeyLocation(testCryptStatusLuks2)), true)
+
+	status := strings.Replace(testCryptStatusLuks2, "keyring", "dm-crypt", 1)
+	assert.Equal(t, isCryptKeyInKeyring(parseCryptKeyLocation(status)), false)
+
+	// cryptsetup before 2.0 doesn't say, and can't use the keyring
+	status = "/dev/mapper/crypt-data is active.\n  type:    LUKS1\n  cipher:  aes-xts-plain64\n"
+	assert.Equal(t, parseCryptKeyLocation(status), "dm-crypt")
+}
+
+func TestCheckCryptResizable(t *testing.T) {
+	defer useFakeSysfs(t)()
+	defer useFakeCryptsetupStatus(testCryptStatusLuks2)()
+	addFakeDmDevice(t, "dm-0", "crypt-data", "CRYPT-LUKS2-abc-crypt-data")
+
+	err := checkCryptResizable("dm-0", "")
+	assert.Error(t, err, "crypt-data keeps its volume key in the kernel keyring, so resizing it needs a passphrase; pass --crypt-keyfile to use a keyfile instead")
+	assert.NilError(t, checkCryptResizable("dm-0", "/etc/keys/data.key"))
+}
+
+func useFakeCryptsetupStatus(status string) func() {
+	oldCryptsetupStatus := cryptsetupStatus
+	cryptsetupStatus = func(mapping string) string { return status }
+	return func() { cryptsetupStatus = oldCryptsetupStatus }
+}
+
+func TestCryptsetupResizeCommand(t *testing.T) {
+	assert.DeepEqual(t, cryptsetupResizeCommand("crypt-data", ""), []string{"cryptsetup", "resize", "crypt-data"})
+	assert.DeepEqual(t, cryptsetupResizeCommand("crypt-data", "/etc/keys/data.key"), []string{"cryptsetup", "resize", "--key-file", "/etc/keys/data.key", "crypt-data"})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// _IOW('f', 16, __u64) from linux/ext4.h
+const ext4IocResizeFs = 0x40086610
+
+const ext4SuperblockOffset = 1024
+const ext4SuperMagic = 0xef53
+const ext4FeatureIncompat64bit = 0x80
+
+// The handful of superblock fields we need, see
+// https://www.kernel.org/doc/html/latest/filesystems/ext4/super.html
+type ext4Superblock struct {
+	BlocksCount     uint64
+	BlockSize       uint64
+	FeatureIncompat uint32
+}
+
+func (s ext4Superblock) Has64bit() bool {
+	return s.FeatureIncompat&ext4FeatureIncompat64bit != 0
+}
+
+func parseExt4Superblock(buf []byte) (ext4Superblock, error) {
+	var sb ext4Superblock
+	if len(buf) < 1024 || binary.LittleEndian.Uint16(buf[0x38:]) != ext4SuperMagic {
+		return sb, fmt.Errorf("no ext4 superblock found")
+	}
+	sb.BlockSize = 1024 << binary.LittleEndian.Uint32(buf[0x18:])
+	sb.FeatureIncompat = binary.LittleEndian.Uint32(buf[0x60:])
+	sb.BlocksCount = uint64(binary.LittleEndian.Uint32(buf[0x04:]))
+	if sb.Has64bit() {
+		sb.BlocksCount |= uint64(binary.LittleEndian.Uint32(buf[0x150:])) << 32
+	}
+	return sb, nil
+}
+
+func readExt4Superblock(device string) (ext4Superblock, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return ext4Superblock{}, err
+	}
+	defer file.Close()
+	buf := make([]byte, 1024)
+	if _, err := file.ReadAt(buf, ext4SuperblockOffset); err != nil {
+		return ext4Superblock{}, err
+	}
+	return parseExt4Superblock(buf)
+}
+
+type ext4ResizeErrorKind int
+
+const (
+	ext4ResizeFailed ext4ResizeErrorKind = iota
+	ext4ResizeNotPermitted
+	ext4ResizeNoReservedGDT
+	ext4ResizeNeeds64bit
+)
+
+// Why EXT4_IOC_RESIZE_FS didn't work, along with the errno it gave (if any)
+type ext4ResizeError struct {
+	Mount  string
+	Blocks uint64
+	Kind   ext4ResizeErrorKind
+	Errno  syscall.Errno
+}
+
+func (e *ext4ResizeError) Error() string {
+	switch e.Kind {
+	case ext4ResizeNotPermitted:
+		return fmt.Sprintf("not permitted to grow %s, it needs CAP_SYS_RESOURCE", e.Mount)
+	case ext4ResizeNoReservedGDT:
+		return fmt.Sprintf("%s has run out of room in its resize inode to grow to %d blocks", e.Mount, e.Blocks)
+	case ext4ResizeNeeds64bit:
+		return fmt.Sprintf("%s needs the 64bit feature to grow to %d blocks", e.Mount, e.Blocks)
+	}
+	return fmt.Sprintf("couldn't grow %s to %d blocks: %v", e.Mount, e.Blocks, e.Errno)
+}
+
+// resize2fs can't do anything about permissions or the 64bit feature
+// either, but it might manage where the kernel's ioctl couldn't.
+func (e *ext4ResizeError) CanFallBack() bool {
+	return e.Kind != ext4ResizeNotPermitted && e.Kind != ext4ResizeNeeds64bit
+}
+
+func ext4ResizeErrorFromErrno(mount string, blocks uint64, errno syscall.Errno) *ext4ResizeError {
+	kind := ext4ResizeFailed
+	switch errno {
+	case syscall.EPERM:
+		kind = ext4ResizeNotPermitted
+	case syscall.ENOSPC:
+		kind = ext4ResizeNoReservedGDT
+	}
+	return &ext4ResizeError{Mount: mount, Blocks: blocks, Kind: kind, Errno: errno}
+}
+
+// Grows a mounted ext4 filesystem to fill its device, straight through
+// the kernel instead of via resize2fs.
+func resizeExt4Online(target resizeTarget, dryRun bool) error {
+	if len(target.StackDevices) == 0 {
+		return fmt.Errorf("don't know what device %s is on", target.Mount)
+	}
+	sb, err := readExt4Superblock(target.Device)
+	if err != nil {
+		return err
+	}
+	size, err := blockDeviceSize(target.StackDevices[0])
+	if err != nil {
+		return err
+	}
+	blocks := uint64(size) / sb.BlockSize
+	if blocks <= sb.BlocksCount {
+		if dryRun {
+			// The device won't have grown yet in a dry run
+			log.Printf("Would grow %s from %d blocks to fill %s with EXT4_IOC_RESIZE_FS, once it's bigger", target.Mount, sb.BlocksCount, target.Device)
+			return nil
+		}
+		log.Printf("%s already has %d blocks, which fills %s", target.Mount, sb.BlocksCount, target.Device)
+		return nil
+	}
+	if blocks > 0xffffffff && !sb.Has64bit() {
+		return &ext4ResizeError{Mount: target.Mount, Blocks: blocks, Kind: ext4ResizeNeeds64bit}
+	}
+	if dryRun {
+		log.Printf("Would grow %s from %d to %d blocks with EXT4_IOC_RESIZE_FS", target.Mount, sb.BlocksCount, blocks)
+		return nil
+	}
+	mount, err := os.Open(target.Mount)
+	if err != nil {
+		return err
+	}
+	defer mount.Close()
+	if err := ioctl(mount.Fd(), ext4IocResizeFs, unsafe.Pointer(&blocks)); err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			return ext4ResizeErrorFromErrno(target.Mount, blocks, errno)
+		}
+		return err
+	}
+	log.Printf("Grew %s from %d to %d blocks", target.Mount, sb.BlocksCount, blocks)
+	return nil
+}
+
+func resizeExtFilesystem(target resizeTarget, dryRun bool) {
+	if target.FSType == "ext4" {
+		err := resizeExt4Online(target, dryRun)
+		if err == nil {
+			return
+		}
+		if resizeErr, ok := err.(*ext4ResizeError); ok && !resizeErr.CanFallBack() {
+			log.Panic(err)
+		}
+		log.Printf("Couldn't grow %s with EXT4_IOC_RESIZE_FS (%v), falling back to resize2fs", target.Mount, err)
+	}
+	safeRun([]string{"resize2fs", target.Device}, dryRun)
+}
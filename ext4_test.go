@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func testExt4Superblock(blocks uint64, logBlockSize uint32, incompat uint32) []byte {
+	buf := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(buf[0x04:], uint32(blocks))
+	binary.LittleEndian.PutUint32(buf[0x18:], logBlockSize)
+	binary.LittleEndian.PutUint16(buf[0x38:], ext4SuperMagic)
+	binary.LittleEndian.PutUint32(buf[0x60:], incompat)
+	binary.LittleEndian.PutUint32(buf[0x150:], uint32(blocks>>32))
+	return buf
+}
+
+func TestParseExt4Superblock(t *testing.T) {
+	sb, err := parseExt4Superblock(testExt4Superblock(2621440, 2, 0x2c2))
+	assert.NilError(t, err)
+	assert.Equal(t, sb.BlocksCount, uint64(2621440))
+	assert.Equal(t, sb.BlockSize, uint64(4096))
+	assert.Equal(t, sb.Has64bit(), true)
+
+	sb, err = parseExt4Superblock(testExt4Superblock(1<<32+5, 2, 0x2c2))
+	assert.NilError(t, err)
+	assert.Equal(t, sb.BlocksCount, uint64(1<<32+5))
+
+	// Without 64bit the high half of the block count isn't there
+	sb, err = parseExt4Superblock(testExt4Superblock(1<<32+5, 0, 0x242))
+	assert.NilError(t, err)
+	assert.Equal(t, sb.BlocksCount, uint64(5))
+	assert.Equal(t, sb.BlockSize, uint64(1024))
+	assert.Equal(t, sb.Has64bit(), false)
+
+	_, err = parseExt4Superblock(make([]byte, 1024))
+	assert.Error(t, err, "no ext4 superblock found")
+}
+
+func TestExt4ResizeErrors(t *testing.T) {
+	err := ext4ResizeErrorFromErrno("/data", 1000, syscall.EPERM)
+	assert.Equal(t, err.Kind, ext4ResizeNotPermitted)
+	assert.Equal(t, err.CanFallBack(), false)
+	assert.Error(t, err, "not permitted to grow /data, it needs CAP_SYS_RESOURCE")
+
+	err = ext4ResizeErrorFromErrno("/data", 1000, syscall.ENOSPC)
+	assert.Equal(t, err.Kind, ext4ResizeNoReservedGDT)
+	assert.Equal(t, err.CanFallBack(), true)
+	assert.Error(t, err, "/data has run out of room in its resize inode to grow to 1000 blocks")
+
+	err = ext4ResizeErrorFromErrno("/data", 1000, syscall.ENOTTY)
+	assert.Equal(t, err.Kind, ext4ResizeFailed)
+	assert.Equal(t, err.CanFallBack(), true)
+
+	err = &ext4ResizeError{Mount: "/data", Blocks: 1 << 33, Kind: ext4ResizeNeeds64bit}
+	assert.Equal(t, err.CanFallBack(), false)
+	assert.Error(t, err, "/data needs the 64bit feature to grow to 8589934592 blocks")
+}
+
+func TestResizeExt4OnlineDryRun(t *testing.T) {
+	defer useFakeSysfs(t)()
+	// addFakeDisk makes 1GiB disks, and the filesystem is only 512MiB of it
+	addFakeDisk(t, "nvme1n1")
+	image := createDiskImage(t, 16*mib)
+	defer removeDiskImage(image)
+	_, err := image.WriteAt(testExt4Superblock(131072, 2, 0x242), ext4SuperblockOffset)
+	assert.NilError(t, err)
+
+	target := resizeTarget{Mount: "/data", FSType: "ext4", Device: image.Name(), StackDevices: []string{"nvme1n1"}}
+	output := captureLog(func() { assert.NilError(t, resizeExt4Online(target, true)) })
+	assert.Assert(t, strings.Contains(output, "Would grow /data from 131072 to 262144 blocks"), output)
+
+	// Nothing has grown the disk yet in a dry run, which is the usual case
+	writeSysfsFile(t, "class/block/nvme1n1/size", "1048576")
+	output = captureLog(func() { assert.NilError(t, resizeExt4Online(target, true)) })
+	assert.Assert(t, strings.Contains(output, "Would grow /data from 131072 blocks to fill"), output)
+
+	// 16TiB of 4KiB blocks is more than 32 bits can count
+	writeSysfsFile(t, "class/block/nvme1n1/size", "34359738368")
+	err = resizeExt4Online(target, true)
+	assert.Error(t, err, "/data needs the 64bit feature to grow to 4294967296 blocks")
+}
+
+func captureLog(f func()) string {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return output.String()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+func canResizeFilesystem(fsType string) bool {
+	switch fsType {
+	case "ext2", "ext3", "ext4", "xfs", "btrfs", "zfs":
+		return true
+	}
+	return false
+}
+
+// Returns whether a filesystem needs to grow, and the least it needs to
+// grow by, 0 meaning the usual amount will do.
+func filesystemNeedsResizing(target resizeTarget, thresholds usageThresholds, verbose bool) (bool, float64) {
+	switch target.FSType {
+	case "btrfs":
+		return btrfsNeedsResizing(target.Mount, thresholds)
+	case "zfs":
+		return zpoolNeedsResizing(target.Pool, thresholds)
+	}
+	return mountNeedsResizing(target.Mount, thresholds, verbose)
+}
+
+// How full a filesystem is, going by the same measure its threshold uses
+func filesystemUsedFraction(target resizeTarget, reservedAsUsed bool) float64 {
+	switch target.FSType {
+	case "btrfs":
+		return btrfsUsageOf(target.Mount).DataUsedFraction()
+	case "zfs":
+		return zpoolCapacityOf(target.Pool).UsedFraction()
+	}
+	usage, err := statfsUsage(target.Mount)
+	if err != nil {
+		log.Panic(err)
+	}
+	return usage.UsedFraction(reservedAsUsed)
+}
+
+func resizeFilesystem(target resizeTarget, dryRun bool) {
+	if dryRun {
+		log.Printf("Would resize %s filesystem on %s\n", target.FSType, target.Device)
+	} else {
+		log.Printf("Going to resize %s filesystem on %s!\n", target.FSType, target.Device)
+	}
+	switch target.FSType {
+	case "xfs":
+		resizeXfsFilesystem(target.Mount, dryRun)
+	case "btrfs":
+		resizeBtrfsFilesystem(target.Mount, target.StackDevices, dryRun)
+	case "zfs":
+		expandZpool(target.Pool, target.StackDevices, dryRun)
+	default:
+		resizeExtFilesystem(target, dryRun)
+	}
+}
+
+// Pulls the data section block count out of xfs_info, which looks like:
+// data     =                       bsize=4096   blocks=262144, imaxpct=25
+func parseXfsInfoDataBlocks(xfsInfo string) (uint64, error) {
+	for _, line := range strings.Split(xfsInfo, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "data") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.Replace(line, ",", " ", -1)) {
+			if strings.HasPrefix(field, "blocks=") {
+				return strconv.ParseUint(strings.TrimPrefix(field, "blocks="), 10, 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("couldn't find the data block count in xfs_info output:\n%s", xfsInfo)
+}
+
+func xfsDataBlocks(mount string) uint64 {
+	blocks, err := parseXfsInfoDataBlocks(safeRun([]string{"xfs_info", mount}, false))
+	if err != nil {
+		log.Panic(err)
+	}
+	return blocks
+}
+
+// XFS can only be grown while mounted, and xfs_growfs wants the mount
+// point rather than the partition.
+func resizeXfsFilesystem(mount string, dryRun bool) {
+	before := xfsDataBlocks(mount)
+	log.Printf("%s has %d XFS data blocks before growing", mount, before)
+	safeRun([]string{"xfs_growfs", mount}, dryRun)
+	if dryRun {
+		return
+	}
+	after := xfsDataBlocks(mount)
+	if after <= before {
+		log.Panicf("xfs_growfs ran on %s but it still has %d data blocks", mount, after)
+	}
+	log.Printf("%s grew from %d to %d XFS data blocks", mount, before, after)
+}
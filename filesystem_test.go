@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testXfsInfo = `meta-data=/dev/nvme1n1           isize=512    agcount=4, agsize=655360 blks
+         =                       sectsz=512   attr=2, projid32bit=1
+         =                       crc=1        finobt=1, sparse=1, rmapbt=0
+         =                       reflink=1
+data     =                       bsize=4096   blocks=2621440, imaxpct=25
+         =                       sunit=0      swidth=0 blks
+naming   =version 2              bsize=4096   ascii-ci=0, ftype=1
+log      =internal log           bsize=4096   blocks=2560, version=2
+         =                       sectsz=512   sunit=0 blks, lazy-count=1
+realtime =none                   extsz=4096   blocks=0, rtextents=0
+`
+
+func TestParseXfsInfoDataBlocks(t *testing.T) {
+	blocks, err := parseXfsInfoDataBlocks(testXfsInfo)
+	assert.NilError(t, err)
+	assert.Equal(t, blocks, uint64(2621440))
+
+	_, err = parseXfsInfoDataBlocks("meta-data=/dev/nvme1n1 isize=512\n")
+	assert.ErrorContains(t, err, "couldn't find the data block count")
+}
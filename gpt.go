@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const gptSignature = "EFI PART"
+const gptHeaderSize = 92
+
+// The on-disk GPT header, see the UEFI spec section 5.3.2
+type gptHeader struct {
+	Signature                [8]byte
+	Revision                 uint32
+	HeaderSize               uint32
+	HeaderCRC32              uint32
+	Reserved                 uint32
+	MyLBA                    uint64
+	AlternateLBA             uint64
+	FirstUsableLBA           uint64
+	LastUsableLBA            uint64
+	DiskGUID                 [16]byte
+	PartitionEntryLBA        uint64
+	NumberOfPartitionEntries uint32
+	SizeOfPartitionEntry     uint32
+	PartitionEntryArrayCRC32 uint32
+}
+
+// The fixed part of a GPT partition entry, entries can be bigger than this
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	StartLBA   uint64
+	EndLBA     uint64
+	Attributes uint64
+	Name       [72]byte
+}
+
+func (e gptEntry) IsUsed() bool {
+	return e.TypeGUID != [16]byte{}
+}
+
+type gptTable struct {
+	Header  gptHeader
+	Entries []byte
+}
+
+func (t gptTable) NumEntries() int {
+	return int(t.Header.NumberOfPartitionEntries)
+}
+
+// Partitions are numbered from 1, entries from 0
+func (t gptTable) Entry(number int) gptEntry {
+	var entry gptEntry
+	offset := (number - 1) * int(t.Header.SizeOfPartitionEntry)
+	binary.Read(bytes.NewReader(t.Entries[offset:]), binary.LittleEndian, &entry)
+	return entry
+}
+
+func (t gptTable) SetEntry(number int, entry gptEntry) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, entry)
+	offset := (number - 1) * int(t.Header.SizeOfPartitionEntry)
+	copy(t.Entries[offset:], buf.Bytes())
+}
+
+func (t gptTable) EntrySectors(sectorSize int64) uint64 {
+	size := int64(len(t.Entries))
+	return uint64((size + sectorSize - 1) / sectorSize)
+}
+
+func gptHeaderCRC(header gptHeader) uint32 {
+	header.HeaderCRC32 = 0
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	return crc32.ChecksumIEEE(buf.Bytes()[:header.HeaderSize])
+}
+
+func readGPT(disk io.ReaderAt, sectorSize int64) (gptTable, error) {
+	return readGPTAt(disk, 1, sectorSize)
+}
+
+// Reads the copy of the table with its header at the given LBA, which is
+// 1 for the primary and the last sector of the disk for the backup.
+func readGPTAt(disk io.ReaderAt, lba uint64, sectorSize int64) (gptTable, error) {
+	var table gptTable
+	sector := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(sector, int64(lba)*sectorSize); err != nil {
+		return table, fmt.Errorf("couldn't read the GPT header: %v", err)
+	}
+	binary.Read(bytes.NewReader(sector), binary.LittleEndian, &table.Header)
+	header := table.Header
+	if string(header.Signature[:]) != gptSignature {
+		return table, fmt.Errorf("no GPT signature found")
+	}
+	if header.HeaderSize < gptHeaderSize || int64(header.HeaderSize) > sectorSize {
+		return table, fmt.Errorf("GPT header has a bogus size of %d", header.HeaderSize)
+	}
+	if gptHeaderCRC(header) != header.HeaderCRC32 {
+		return table, fmt.Errorf("GPT header checksum doesn't match")
+	}
+	if header.SizeOfPartitionEntry < 128 || header.NumberOfPartitionEntries == 0 {
+		return table, fmt.Errorf("GPT has bogus partition entries (%d of size %d)", header.NumberOfPartitionEntries, header.SizeOfPartitionEntry)
+	}
+	table.Entries = make([]byte, header.NumberOfPartitionEntries*header.SizeOfPartitionEntry)
+	if _, err := disk.ReadAt(table.Entries, int64(header.PartitionEntryLBA)*sectorSize); err != nil {
+		return table, fmt.Errorf("couldn't read the GPT partition entries: %v", err)
+	}
+	if crc32.ChecksumIEEE(table.Entries) != header.PartitionEntryArrayCRC32 {
+		return table, fmt.Errorf("GPT partition entries checksum doesn't match")
+	}
+	return table, nil
+}
+
+func writeAt(disk io.WriterAt, data []byte, offset int64) error {
+	_, err := disk.WriteAt(data, offset)
+	return err
+}
+
+func writeGPTHeader(disk io.WriterAt, header gptHeader, sectorSize int64) error {
+	header.HeaderCRC32 = gptHeaderCRC(header)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	sector := make([]byte, sectorSize)
+	copy(sector, buf.Bytes())
+	return writeAt(disk, sector, int64(header.MyLBA)*sectorSize)
+}
+
+// Writes out the backup then the primary copy of the table, with the
+// backup placed at the very end of a disk of totalSectors. This is how
+// the backup gets moved after the disk has grown.
+func writeGPT(disk io.WriterAt, table gptTable, totalSectors uint64, sectorSize int64) error {
+	entrySectors := table.EntrySectors(sectorSize)
+	primary := table.Header
+	primary.MyLBA = 1
+	primary.AlternateLBA = totalSectors - 1
+	primary.PartitionEntryLBA = 2
+	primary.LastUsableLBA = totalSectors - 1 - entrySectors - 1
+	primary.PartitionEntryArrayCRC32 = crc32.ChecksumIEEE(table.Entries)
+
+	backup := primary
+	backup.MyLBA = primary.AlternateLBA
+	backup.AlternateLBA = primary.MyLBA
+	backup.PartitionEntryLBA = totalSectors - 1 - entrySectors
+
+	if err := writeAt(disk, table.Entries, int64(backup.PartitionEntryLBA)*sectorSize); err != nil {
+		return err
+	}
+	if err := writeGPTHeader(disk, backup, sectorSize); err != nil {
+		return err
+	}
+	if err := writeAt(disk, table.Entries, int64(primary.PartitionEntryLBA)*sectorSize); err != nil {
+		return err
+	}
+	return writeGPTHeader(disk, primary, sectorSize)
+}
+
+// Grows a GPT partition as far as it can go on a disk of totalSectors,
+// keeping the end aligned. Returns the old and new extents of the partition.
+func growGPTPartition(disk partitionedDisk, totalSectors uint64, sectorSize int64, number int, dryRun bool) (partitionExtent, partitionExtent, error) {
+	var before, after partitionExtent
+	table, err := readGPT(disk, sectorSize)
+	if err != nil {
+		return before, after, err
+	}
+	if number < 1 || number > table.NumEntries() {
+		return before, after, fmt.Errorf("partition %d doesn't exist in the GPT", number)
+	}
+	entry := table.Entry(number)
+	if !entry.IsUsed() {
+		return before, after, fmt.Errorf("partition %d doesn't exist in the GPT", number)
+	}
+	for i := 1; i <= table.NumEntries(); i++ {
+		other := table.Entry(i)
+		if i != number && other.IsUsed() && other.StartLBA > entry.StartLBA {
+			return before, after, &partitionNotLastError{Number: number, Next: i}
+		}
+	}
+	before = partitionExtent{Start: entry.StartLBA, Sectors: entry.EndLBA - entry.StartLBA + 1}
+	lastUsable := totalSectors - 1 - table.EntrySectors(sectorSize) - 1
+	end := alignedPartitionEnd(lastUsable, sectorSize)
+	if end <= entry.EndLBA {
+		return before, before, nil
+	}
+	after = partitionExtent{Start: entry.StartLBA, Sectors: end - entry.StartLBA + 1}
+	if dryRun {
+		return before, after, nil
+	}
+	entry.EndLBA = end
+	table.SetEntry(number, entry)
+	if err := writeGPT(disk, table, totalSectors, sectorSize); err != nil {
+		return before, after, err
+	}
+	return before, after, updateProtectiveMBR(disk, totalSectors)
+}
+
+// Adds a partition in the free space after the last one, out to the end of
+// a disk of totalSectors. Returns the new partition's number and extent.
+func addGPTPartition(disk partitionedDisk, totalSectors uint64, sectorSize int64, typeGUID [16]byte, dryRun bool) (int, partitionExtent, error) {
+	var extent partitionExtent
+	table, err := readGPT(disk, sectorSize)
+	if err != nil {
+		return 0, extent, err
+	}
+	number := 0
+	lastEnd := table.Header.FirstUsableLBA - 1
+	for i := table.NumEntries(); i >= 1; i-- {
+		entry := table.Entry(i)
+		if !entry.IsUsed() {
+			number = i
+		} else if entry.EndLBA > lastEnd {
+			lastEnd = entry.EndLBA
+		}
+	}
+	if number == 0 {
+		return 0, extent, fmt.Errorf("there are no free entries left in the GPT")
+	}
+	start := alignedPartitionStart(lastEnd+1, sectorSize)
+	lastUsable := totalSectors - 1 - table.EntrySectors(sectorSize) - 1
+	end := alignedPartitionEnd(lastUsable, sectorSize)
+	if end <= start {
+		return 0, extent, &noFreeSpaceError{"there is no free space after the last partition"}
+	}
+	extent = partitionExtent{Start: start, Sectors: end - start + 1}
+	if dryRun {
+		return number, extent, nil
+	}
+	entry := gptEntry{TypeGUID: typeGUID, StartLBA: start, EndLBA: end}
+	if entry.UniqueGUID, err = randomGUID(); err != nil {
+		return 0, extent, err
+	}
+	table.SetEntry(number, entry)
+	if err := writeGPT(disk, table, totalSectors, sectorSize); err != nil {
+		return 0, extent, err
+	}
+	return number, extent, updateProtectiveMBR(disk, totalSectors)
+}
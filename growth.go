@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Decides how big (in GiB) a volume should grow to, given its size now
+// and how full the filesystem on it is.
+type growthStrategy interface {
+	NewSize(existingSize int64, usedFraction float64) int64
+	String() string
+}
+
+// Floating point would otherwise turn 100 * 1.1 into 110.00000000000001,
+// which rounds up to 111.
+func ceilSize(size float64) int64 {
+	return int64(math.Ceil(math.Round(size*1e6) / 1e6))
+}
+
+// Grows by a percentage, but always by at least MinIncrement, so small
+// volumes actually get bigger.
+type percentGrowth struct {
+	Percent      float64
+	MinIncrement int64
+}
+
+func (g percentGrowth) NewSize(existingSize int64, usedFraction float64) int64 {
+	size := ceilSize(float64(existingSize) * (1 + g.Percent))
+	if size < existingSize+g.MinIncrement {
+		size = existingSize + g.MinIncrement
+	}
+	return size
+}
+
+func (g percentGrowth) String() string {
+	if g.MinIncrement > 0 {
+		return fmt.Sprintf("grow by %.2f%%, at least %dGiB", g.Percent*100, g.MinIncrement)
+	}
+	return fmt.Sprintf("grow by %.2f%%", g.Percent*100)
+}
+
+// Grows by the same number of GiB every time
+type fixedGrowth struct {
+	Step int64
+}
+
+func (g fixedGrowth) NewSize(existingSize int64, usedFraction float64) int64 {
+	return existingSize + g.Step
+}
+
+func (g fixedGrowth) String() string {
+	return fmt.Sprintf("grow by %dGiB", g.Step)
+}
+
+// Grows until the filesystem would be Target full. This assumes the
+// filesystem fills the volume, which is near enough.
+type targetUsageGrowth struct {
+	Target float64
+}
+
+func (g targetUsageGrowth) NewSize(existingSize int64, usedFraction float64) int64 {
+	size := ceilSize(float64(existingSize) * usedFraction / g.Target)
+	if size < existingSize {
+		return existingSize
+	}
+	return size
+}
+
+func (g targetUsageGrowth) String() string {
+	return fmt.Sprintf("grow until %.2f%% used", g.Target*100)
+}
+
+// Everything that goes into how much one filesystem's volumes grow.
+// MinPercent is the least they need to grow by to get back under the
+// thresholds, and UsedFraction is how full the filesystem is now.
+type growth struct {
+	Strategy     growthStrategy
+	Granularity  int64
+	MinPercent   float64
+	UsedFraction float64
+}
+
+func (g growth) NewSize(existingSize int64) int64 {
+	size := g.Strategy.NewSize(existingSize, g.UsedFraction)
+	if g.MinPercent > 0 {
+		if least := ceilSize(float64(existingSize) * (1 + g.MinPercent)); size < least {
+			size = least
+		}
+	}
+	if size <= existingSize {
+		return existingSize
+	}
+	return roundUpSize(size, g.Granularity)
+}
+
+func (g growth) String() string {
+	description := g.Strategy.String()
+	if g.MinPercent > 0 {
+		description += fmt.Sprintf(" (or %.2f%% if that's more)", g.MinPercent*100)
+	}
+	if g.Granularity > 1 {
+		description += fmt.Sprintf(", rounded up to %dGiB", g.Granularity)
+	}
+	return description
+}
+
+func roundUpSize(size int64, granularity int64) int64 {
+	if granularity <= 1 {
+		return size
+	}
+	return (size + granularity - 1) / granularity * granularity
+}
+
+// Growth sizes are in whole GiB, like EBS sizes, and 0 turns them off, so
+// anything that would round down to 0 must be a mistake.
+func parseGrowthSize(raw string) (int64, error) {
+	size, err := parseSize(raw)
+	if err != nil {
+		return 0, err
+	}
+	if size > 0 && size < 1<<30 {
+		return 0, fmt.Errorf("%s is less than 1GiB, the smallest amount a volume can grow by", raw)
+	}
+	return int64(size >> 30), nil
+}
+
+// Picks the growth strategy by name, with sizes in GiB
+func newGrowthStrategy(name string, percent float64, minIncrement int64, step int64, targetUsage float64) (growthStrategy, error) {
+	switch name {
+	case "percent":
+		return percentGrowth{Percent: percent, MinIncrement: minIncrement}, nil
+	case "fixed":
+		if step <= 0 {
+			return nil, fmt.Errorf("the fixed strategy needs a --grow-step of at least 1GiB")
+		}
+		return fixedGrowth{Step: step}, nil
+	case "target":
+		if targetUsage <= 0 || targetUsage >= 1 {
+			return nil, fmt.Errorf("the target strategy needs a --target-usage between 0 and 100")
+		}
+		return targetUsageGrowth{Target: targetUsage}, nil
+	}
+	return nil, fmt.Errorf("don't know the %s growth strategy, it can be percent, fixed or target", name)
+}
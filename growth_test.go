@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestPercentGrowth(t *testing.T) {
+	// Rounding to the nearest GiB used to leave a 5GiB volume at 5GiB
+	assert.Equal(t, percentGrowth{Percent: 0.1}.NewSize(5, 0), int64(6))
+	assert.Equal(t, percentGrowth{Percent: 0.1}.NewSize(100, 0), int64(110))
+	assert.Equal(t, percentGrowth{Percent: 0.1}.NewSize(101, 0), int64(112))
+	assert.Equal(t, percentGrowth{Percent: 0.1, MinIncrement: 4}.NewSize(5, 0), int64(9))
+	assert.Equal(t, percentGrowth{Percent: 0.1, MinIncrement: 4}.NewSize(100, 0), int64(110))
+	assert.Equal(t, percentGrowth{Percent: 0, MinIncrement: 1}.NewSize(100, 0), int64(101))
+	assert.Equal(t, percentGrowth{Percent: 0.1}.String(), "grow by 10.00%")
+	assert.Equal(t, percentGrowth{Percent: 0.1, MinIncrement: 1}.String(), "grow by 10.00%, at least 1GiB")
+}
+
+func TestFixedGrowth(t *testing.T) {
+	assert.Equal(t, fixedGrowth{Step: 10}.NewSize(5, 0.99), int64(15))
+	assert.Equal(t, fixedGrowth{Step: 10}.NewSize(1000, 0.5), int64(1010))
+}
+
+func TestTargetUsageGrowth(t *testing.T) {
+	// 90GiB used of 100, so it needs 90 / 0.7 = 128.57GiB
+	assert.Equal(t, targetUsageGrowth{Target: 0.7}.NewSize(100, 0.9), int64(129))
+	assert.Equal(t, targetUsageGrowth{Target: 0.5}.NewSize(100, 0.5), int64(100))
+	// Already under the target, so nothing to do
+	assert.Equal(t, targetUsageGrowth{Target: 0.7}.NewSize(100, 0.3), int64(100))
+	assert.Equal(t, targetUsageGrowth{Target: 0.7}.NewSize(100, 0), int64(100))
+}
+
+func TestRoundUpSize(t *testing.T) {
+	assert.Equal(t, roundUpSize(101, 1), int64(101))
+	assert.Equal(t, roundUpSize(101, 0), int64(101))
+	assert.Equal(t, roundUpSize(101, 8), int64(104))
+	assert.Equal(t, roundUpSize(104, 8), int64(104))
+	assert.Equal(t, roundUpSize(1, 1024), int64(1024))
+}
+
+func TestGrowth(t *testing.T) {
+	g := growth{Strategy: fixedGrowth{Step: 1}, Granularity: 8}
+	assert.Equal(t, g.NewSize(100), int64(104))
+	// A size that's already a multiple isn't rounded up another step
+	assert.Equal(t, g.NewSize(103), int64(104))
+	// The thresholds can ask for more than the strategy would give
+	g.MinPercent = 0.5
+	assert.Equal(t, g.NewSize(100), int64(152))
+	assert.Equal(t, g.String(), "grow by 1GiB (or 50.00% if that's more), rounded up to 8GiB")
+
+	// Nothing to grow means no rounding either, a 100GiB volume on an
+	// 8GiB granularity isn't bumped to 104
+	g = growth{Strategy: targetUsageGrowth{Target: 0.7}, Granularity: 8, UsedFraction: 0.2}
+	assert.Equal(t, g.NewSize(100), int64(100))
+	g.UsedFraction = 0.9
+	assert.Equal(t, g.NewSize(100), int64(136))
+}
+
+func TestParseGrowthSize(t *testing.T) {
+	size, err := parseGrowthSize("10GiB")
+	assert.NilError(t, err)
+	assert.Equal(t, size, int64(10))
+	size, err = parseGrowthSize("0")
+	assert.NilError(t, err)
+	assert.Equal(t, size, int64(0))
+
+	// These would otherwise quietly turn into 0, which is off
+	_, err = parseGrowthSize("512MiB")
+	assert.Error(t, err, "512MiB is less than 1GiB, the smallest amount a volume can grow by")
+	_, err = parseGrowthSize("500M")
+	assert.ErrorContains(t, err, "less than 1GiB")
+	_, err = parseGrowthSize("big")
+	assert.ErrorContains(t, err, "isn't a size")
+}
+
+func TestNewGrowthStrategy(t *testing.T) {
+	strategy, err := newGrowthStrategy("percent", 0.1, 1, 10, 0.7)
+	assert.NilError(t, err)
+	assert.Equal(t, strategy, growthStrategy(percentGrowth{Percent: 0.1, MinIncrement: 1}))
+	strategy, err = newGrowthStrategy("fixed", 0.1, 1, 10, 0.7)
+	assert.NilError(t, err)
+	assert.Equal(t, strategy, growthStrategy(fixedGrowth{Step: 10}))
+	strategy, err = newGrowthStrategy("target", 0.1, 1, 10, 0.7)
+	assert.NilError(t, err)
+	assert.Equal(t, strategy, growthStrategy(targetUsageGrowth{Target: 0.7}))
+
+	_, err = newGrowthStrategy("fixed", 0.1, 1, 0, 0.7)
+	assert.ErrorContains(t, err, "--grow-step")
+	_, err = newGrowthStrategy("target", 0.1, 1, 10, 1)
+	assert.ErrorContains(t, err, "--target-usage")
+	_, err = newGrowthStrategy("exponential", 0.1, 1, 10, 0.7)
+	assert.ErrorContains(t, err, "exponential")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+func isLvmDevice(name string) bool {
+	uuid, err := readSysfsString(filepath.Join("class/block", name, "dm/uuid"))
+	return err == nil && strings.HasPrefix(uuid, "LVM-")
+}
+
+// lvextend takes extents (-l) for things like +100%FREE and a size (-L)
+// for things like +10G.
+func lvextendCommand(lv string, extend string) []string {
+	if strings.Contains(extend, "%") {
+		return []string{"lvextend", "-l", extend, lv}
+	}
+	return []string{"lvextend", "-L", extend, lv}
+}
+
+// Once the partition underneath has grown, the physical volume needs to
+// be told about it before the logical volume can be extended into it.
+func resizePhysicalVolume(pv string, dryRun bool) {
+	log.Printf("Resizing LVM physical volume %s\n", pv)
+	safeRun([]string{"pvresize", pv}, dryRun)
+}
+
+func extendLogicalVolume(lv string, extend string, dryRun bool) {
+	log.Printf("Extending LVM logical volume %s by %s\n", lv, extend)
+	safeRun(lvextendCommand(lv, extend), dryRun)
+}
+
+// The device mapper names logical volumes vg-lv, with any dashes in
+// either name doubled up.
+func lvmVolumeGroupName(dmName string) string {
+	for i := 0; i < len(dmName); i++ {
+		if dmName[i] != '-' {
+			continue
+		}
+		if i+1 < len(dmName) && dmName[i+1] == '-' {
+			i++
+			continue
+		}
+		return strings.Replace(dmName[:i], "--", "-", -1)
+	}
+	return ""
+}
+
+func lvmVolumeGroup(name string) (string, error) {
+	dmName, err := readSysfsString(filepath.Join("class/block", name, "dm/name"))
+	if err != nil {
+		return "", err
+	}
+	return lvmVolumeGroupName(dmName), nil
+}
+
+func addPhysicalVolume(vg string, pv string, dryRun bool) {
+	log.Printf("Adding %s to LVM volume group %s\n", pv, vg)
+	safeRun([]string{"pvcreate", pv}, dryRun)
+	safeRun([]string{"vgextend", vg, pv}, dryRun)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLvmVolumeGroupName(t *testing.T) {
+	assert.Equal(t, lvmVolumeGroupName("vg-root"), "vg")
+	assert.Equal(t, lvmVolumeGroupName("data--vg-root"), "data-vg")
+	assert.Equal(t, lvmVolumeGroupName("vg-my--lv"), "vg")
+	assert.Equal(t, lvmVolumeGroupName("nodash"), "")
+}
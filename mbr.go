@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const mbrSectorSize = 512
+const mbrEntriesOffset = 446
+const mbrProtectiveType = 0xee
+
+// MBR partitions count sectors with 32 bits, which is where the 2TiB
+// limit (with 512 byte sectors) comes from.
+const mbrMaxSectors = 0xffffffff
+
+// One of the four primary partition entries in an MBR
+type mbrEntry struct {
+	Status   byte
+	CHSFirst [3]byte
+	Type     byte
+	CHSLast  [3]byte
+	FirstLBA uint32
+	Sectors  uint32
+}
+
+func (e mbrEntry) IsUsed() bool {
+	return e.Type != 0 && e.Sectors != 0
+}
+
+// The MBR itself, or one of the EBRs describing logical partitions (which
+// have the same layout), along with the sector it lives in.
+type mbrTable struct {
+	LBA     uint64
+	Sector  []byte
+	Entries [4]mbrEntry
+}
+
+func readMBR(disk partitionedDisk) (mbrTable, error) {
+	return readMBRAt(disk, 0)
+}
+
+func readMBRAt(disk partitionedDisk, lba uint64) (mbrTable, error) {
+	table := mbrTable{LBA: lba, Sector: make([]byte, mbrSectorSize)}
+	if _, err := disk.ReadAt(table.Sector, int64(lba)*mbrSectorSize); err != nil {
+		return table, fmt.Errorf("couldn't read the MBR: %v", err)
+	}
+	if table.Sector[510] != 0x55 || table.Sector[511] != 0xaa {
+		return table, fmt.Errorf("no partition table found")
+	}
+	binary.Read(bytes.NewReader(table.Sector[mbrEntriesOffset:]), binary.LittleEndian, &table.Entries)
+	return table, nil
+}
+
+// Writes the partition entries back, leaving the boot code alone
+func writeMBR(disk partitionedDisk, table mbrTable) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, table.Entries)
+	copy(table.Sector[mbrEntriesOffset:], buf.Bytes())
+	return writeAt(disk, table.Sector, int64(table.LBA)*mbrSectorSize)
+}
+
+func (t mbrTable) IsProtective() bool {
+	for _, entry := range t.Entries {
+		if entry.Type == mbrProtectiveType {
+			return true
+		}
+	}
+	return false
+}
+
+// With LBA addressing the CHS fields are meaningless, and this is the
+// conventional "too big to say" value for them.
+var mbrMaxCHS = [3]byte{0xfe, 0xff, 0xff}
+
+// The protective MBR in front of a GPT covers the whole disk (or as much
+// of it as 32 bits can say), so it needs to grow along with it.
+func updateProtectiveMBR(disk partitionedDisk, totalSectors uint64) error {
+	table, err := readMBR(disk)
+	if err != nil {
+		return err
+	}
+	for i, entry := range table.Entries {
+		if entry.Type != mbrProtectiveType {
+			continue
+		}
+		sectors := totalSectors - uint64(entry.FirstLBA)
+		if sectors > mbrMaxSectors {
+			sectors = mbrMaxSectors
+		}
+		table.Entries[i].Sectors = uint32(sectors)
+		table.Entries[i].CHSLast = mbrMaxCHS
+		return writeMBR(disk, table)
+	}
+	return nil
+}
+
+// Grows a primary MBR partition as far as it can go on a disk of
+// totalSectors, keeping the end aligned.
+func growMBRPartition(disk partitionedDisk, totalSectors uint64, number int, dryRun bool) (partitionExtent, partitionExtent, error) {
+	var before, after partitionExtent
+	table, err := readMBR(disk)
+	if err != nil {
+		return before, after, err
+	}
+	if number < 1 || number > 4 || !table.Entries[number-1].IsUsed() {
+		return before, after, fmt.Errorf("partition %d doesn't exist in the MBR", number)
+	}
+	entry := table.Entries[number-1]
+	for i, other := range table.Entries {
+		if i != number-1 && other.IsUsed() && other.FirstLBA > entry.FirstLBA {
+			return before, after, &partitionNotLastError{Number: number, Next: i + 1}
+		}
+	}
+	before = partitionExtent{Start: uint64(entry.FirstLBA), Sectors: uint64(entry.Sectors)}
+	end := alignedPartitionEnd(totalSectors-1, mbrSectorSize)
+	sectors := end - uint64(entry.FirstLBA) + 1
+	if sectors > mbrMaxSectors {
+		sectors = mbrMaxSectors
+	}
+	if sectors <= uint64(entry.Sectors) {
+		return before, before, nil
+	}
+	after = partitionExtent{Start: uint64(entry.FirstLBA), Sectors: sectors}
+	if dryRun {
+		return before, after, nil
+	}
+	table.Entries[number-1].Sectors = uint32(sectors)
+	table.Entries[number-1].CHSLast = mbrMaxCHS
+	return before, after, writeMBR(disk, table)
+}
+
+// How big a disk can usefully get when this partition is the one being
+// grown, since an MBR partition can't be more than mbrMaxSectors long.
+// Logical partitions are stuck inside their extended partition.
+func mbrUsableSizeLimit(table mbrTable, number int) uint64 {
+	entry := table.Entries[0]
+	if number <= 4 {
+		entry = table.Entries[number-1]
+	} else if extended, ok := table.Extended(); ok {
+		entry = table.Entries[extended-1]
+	}
+	return (uint64(entry.FirstLBA) + mbrMaxSectors) * mbrSectorSize
+}
+
+func isMBRExtendedType(partitionType byte) bool {
+	return partitionType == 0x05 || partitionType == 0x0f || partitionType == 0x85
+}
+
+// Returns the number of the extended partition, if there is one
+func (t mbrTable) Extended() (int, bool) {
+	for i, entry := range t.Entries {
+		if entry.IsUsed() && isMBRExtendedType(entry.Type) {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// Logical partitions are a linked list of EBRs inside the extended
+// partition. Each EBR describes one logical partition, relative to the
+// EBR, and links to the next EBR, relative to the start of the extended
+// partition.
+func readEBRs(disk partitionedDisk, extended mbrEntry) ([]mbrTable, error) {
+	ebrs := []mbrTable{}
+	lba := uint64(extended.FirstLBA)
+	for {
+		ebr, err := readMBRAt(disk, lba)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the EBR at sector %d: %v", lba, err)
+		}
+		if ebr.Entries[0].IsUsed() {
+			ebrs = append(ebrs, ebr)
+		}
+		next := ebr.Entries[1]
+		if !next.IsUsed() {
+			return ebrs, nil
+		}
+		if len(ebrs) > 128 {
+			return nil, fmt.Errorf("too many logical partitions, the EBRs probably loop")
+		}
+		lba = uint64(extended.FirstLBA) + uint64(next.FirstLBA)
+	}
+}
+
+// Where the extended partition (and so the last logical partition in
+// it) should end on a disk of totalSectors.
+func extendedPartitionEnd(extended mbrEntry, totalSectors uint64) uint64 {
+	end := alignedPartitionEnd(totalSectors-1, mbrSectorSize)
+	if end-uint64(extended.FirstLBA)+1 > mbrMaxSectors {
+		end = uint64(extended.FirstLBA) + mbrMaxSectors - 1
+	}
+	return end
+}
+
+// Grows the extended partition to the end of the disk, so there is room
+// for the last logical partition to grow into. Returns the number of the
+// extended partition along with its old and new extents.
+func growMBRExtendedPartition(disk partitionedDisk, totalSectors uint64, dryRun bool) (int, partitionExtent, partitionExtent, error) {
+	var before, after partitionExtent
+	table, err := readMBR(disk)
+	if err != nil {
+		return 0, before, after, err
+	}
+	number, ok := table.Extended()
+	if !ok {
+		return 0, before, after, fmt.Errorf("there is no extended partition in the MBR")
+	}
+	entry := table.Entries[number-1]
+	for i, other := range table.Entries {
+		if i != number-1 && other.IsUsed() && other.FirstLBA > entry.FirstLBA {
+			return number, before, after, &partitionNotLastError{Number: number, Next: i + 1}
+		}
+	}
+	before = partitionExtent{Start: uint64(entry.FirstLBA), Sectors: uint64(entry.Sectors)}
+	sectors := extendedPartitionEnd(entry, totalSectors) - uint64(entry.FirstLBA) + 1
+	if sectors <= uint64(entry.Sectors) {
+		return number, before, before, nil
+	}
+	after = partitionExtent{Start: uint64(entry.FirstLBA), Sectors: sectors}
+	if dryRun {
+		return number, before, after, nil
+	}
+	table.Entries[number-1].Sectors = uint32(sectors)
+	table.Entries[number-1].CHSLast = mbrMaxCHS
+	return number, before, after, writeMBR(disk, table)
+}
+
+// Grows a logical partition to where the extended partition ends (or will
+// end, once it has grown), keeping the end aligned.
+func growMBRLogicalPartition(disk partitionedDisk, totalSectors uint64, number int, dryRun bool) (partitionExtent, partitionExtent, error) {
+	var before, after partitionExtent
+	table, err := readMBR(disk)
+	if err != nil {
+		return before, after, err
+	}
+	extended, ok := table.Extended()
+	if !ok {
+		return before, after, fmt.Errorf("partition %d doesn't exist in the MBR", number)
+	}
+	ebrs, err := readEBRs(disk, table.Entries[extended-1])
+	if err != nil {
+		return before, after, err
+	}
+	if number-5 >= len(ebrs) {
+		return before, after, fmt.Errorf("partition %d doesn't exist in the MBR", number)
+	}
+	if number-5 < len(ebrs)-1 {
+		return before, after, &partitionNotLastError{Number: number, Next: number + 1}
+	}
+	ebr := ebrs[number-5]
+	entry := ebr.Entries[0]
+	start := ebr.LBA + uint64(entry.FirstLBA)
+	before = partitionExtent{Start: start, Sectors: uint64(entry.Sectors)}
+	sectors := extendedPartitionEnd(table.Entries[extended-1], totalSectors) - start + 1
+	if sectors <= uint64(entry.Sectors) {
+		return before, before, nil
+	}
+	after = partitionExtent{Start: start, Sectors: sectors}
+	if dryRun {
+		return before, after, nil
+	}
+	ebr.Entries[0].Sectors = uint32(sectors)
+	ebr.Entries[0].CHSLast = mbrMaxCHS
+	return before, after, writeMBR(disk, ebr)
+}
+
+// GPT partition type GUIDs (in their on-disk mixed endian form) for the
+// MBR types we know how to convert.
+var mbrTypeToGPTType = map[byte][16]byte{
+	// Linux filesystem 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+	0x83: {0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4},
+	// Linux swap 0657FD6D-A4AB-43C4-84E5-0933C84B4F4F
+	0x82: {0x6d, 0xfd, 0x57, 0x06, 0xab, 0xa4, 0xc4, 0x43, 0x84, 0xe5, 0x09, 0x33, 0xc8, 0x4b, 0x4f, 0x4f},
+	// Linux LVM E6D6D379-F507-44C2-A23C-238F2A3DF928
+	0x8e: {0x79, 0xd3, 0xd6, 0xe6, 0x07, 0xf5, 0xc2, 0x44, 0xa2, 0x3c, 0x23, 0x8f, 0x2a, 0x3d, 0xf9, 0x28},
+	// Linux RAID A19D880F-05FC-4D3B-A006-743F0F84911E
+	0xfd: {0x0f, 0x88, 0x9d, 0xa1, 0xfc, 0x05, 0x3b, 0x4d, 0xa0, 0x06, 0x74, 0x3f, 0x0f, 0x84, 0x91, 0x1e},
+	// EFI System C12A7328-F81F-11D2-BA4B-00A0C93EC93B
+	0xef: {0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b},
+}
+
+// The GPT "legacy BIOS bootable" attribute, which is what the MBR active flag becomes
+const gptLegacyBootableAttribute = 1 << 2
+
+// The primary GPT needs sectors 1 through 33 (with 128 entries), which is
+// also where bootloaders like GRUB like to hide on MBR disks. So we only
+// convert when nothing at all is there.
+func checkMBRConvertible(disk partitionedDisk, table mbrTable) error {
+	const gptSectors = 34
+	for i, entry := range table.Entries {
+		if !entry.IsUsed() {
+			continue
+		}
+		if isMBRExtendedType(entry.Type) {
+			return fmt.Errorf("partition %d is an extended partition, which can't be converted", i+1)
+		}
+		if _, ok := mbrTypeToGPTType[entry.Type]; !ok {
+			return fmt.Errorf("partition %d has type 0x%02x, which we don't know the GPT equivalent of", i+1, entry.Type)
+		}
+		if entry.FirstLBA < gptSectors {
+			return fmt.Errorf("partition %d starts at sector %d, leaving no room for a GPT", i+1, entry.FirstLBA)
+		}
+	}
+	gap := make([]byte, (gptSectors-1)*mbrSectorSize)
+	if _, err := disk.ReadAt(gap, mbrSectorSize); err != nil {
+		return err
+	}
+	for _, b := range gap {
+		if b != 0 {
+			return fmt.Errorf("there is something (probably a bootloader) in the sectors a GPT would need")
+		}
+	}
+	return nil
+}
+
+func randomGUID() ([16]byte, error) {
+	var guid [16]byte
+	if _, err := rand.Read(guid[:]); err != nil {
+		return guid, err
+	}
+	// Version 4, variant 1, keeping in mind the first three fields are little endian
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid, nil
+}
+
+// Rewrites an MBR partition table as a GPT in place, keeping every
+// partition where it is and with the same number. This needs the disk to
+// have already grown, so there is room at the end for the backup GPT.
+func convertMBRToGPT(disk partitionedDisk, totalSectors uint64) error {
+	mbr, err := readMBR(disk)
+	if err != nil {
+		return err
+	}
+	if err := checkMBRConvertible(disk, mbr); err != nil {
+		return err
+	}
+	table := gptTable{
+		Header: gptHeader{
+			Revision:                 0x00010000,
+			HeaderSize:               gptHeaderSize,
+			FirstUsableLBA:           34,
+			NumberOfPartitionEntries: 128,
+			SizeOfPartitionEntry:     128,
+		},
+		Entries: make([]byte, 128*128),
+	}
+	copy(table.Header.Signature[:], gptSignature)
+	if table.Header.DiskGUID, err = randomGUID(); err != nil {
+		return err
+	}
+	lastUsable := totalSectors - 1 - table.EntrySectors(mbrSectorSize) - 1
+	for i, entry := range mbr.Entries {
+		if !entry.IsUsed() {
+			continue
+		}
+		end := uint64(entry.FirstLBA) + uint64(entry.Sectors) - 1
+		if end > lastUsable {
+			return fmt.Errorf("partition %d runs right up to the end of the disk, leaving no room for the backup GPT", i+1)
+		}
+		gpt := gptEntry{
+			TypeGUID: mbrTypeToGPTType[entry.Type],
+			StartLBA: uint64(entry.FirstLBA),
+			EndLBA:   end,
+		}
+		if gpt.UniqueGUID, err = randomGUID(); err != nil {
+			return err
+		}
+		if entry.Status&0x80 != 0 {
+			gpt.Attributes |= gptLegacyBootableAttribute
+		}
+		table.SetEntry(i+1, gpt)
+	}
+	if err := writeGPT(disk, table, totalSectors, mbrSectorSize); err != nil {
+		return err
+	}
+	sectors := totalSectors - 1
+	if sectors > mbrMaxSectors {
+		sectors = mbrMaxSectors
+	}
+	mbr.Entries = [4]mbrEntry{{
+		CHSFirst: [3]byte{0x00, 0x02, 0x00},
+		Type:     mbrProtectiveType,
+		CHSLast:  mbrMaxCHS,
+		FirstLBA: 1,
+		Sectors:  uint32(sectors),
+	}}
+	return writeMBR(disk, mbr)
+}
+
+// Adds a primary partition in the free space after the last one, out to
+// the end of a disk of totalSectors (or as far as an MBR can go).
+// Returns the new partition's number and extent.
+func addMBRPartition(disk partitionedDisk, totalSectors uint64, partitionType byte, dryRun bool) (int, partitionExtent, error) {
+	var extent partitionExtent
+	table, err := readMBR(disk)
+	if err != nil {
+		return 0, extent, err
+	}
+	number := 0
+	var lastEnd uint64
+	for i := len(table.Entries) - 1; i >= 0; i-- {
+		entry := table.Entries[i]
+		if !entry.IsUsed() {
+			number = i + 1
+		} else if end := uint64(entry.FirstLBA) + uint64(entry.Sectors) - 1; end > lastEnd {
+			lastEnd = end
+		}
+	}
+	if number == 0 {
+		return 0, extent, fmt.Errorf("all four primary partitions are already in use")
+	}
+	start := alignedPartitionStart(lastEnd+1, mbrSectorSize)
+	end := alignedPartitionEnd(totalSectors-1, mbrSectorSize)
+	if start > mbrMaxSectors || end <= start {
+		return 0, extent, &noFreeSpaceError{"there is no free space an MBR can use after the last partition"}
+	}
+	sectors := end - start + 1
+	if sectors > mbrMaxSectors {
+		sectors = mbrMaxSectors
+	}
+	extent = partitionExtent{Start: start, Sectors: sectors}
+	if dryRun {
+		return number, extent, nil
+	}
+	table.Entries[number-1] = mbrEntry{
+		Type:     partitionType,
+		CHSFirst: mbrMaxCHS,
+		CHSLast:  mbrMaxCHS,
+		FirstLBA: uint32(start),
+		Sectors:  uint32(sectors),
+	}
+	return number, extent, writeMBR(disk, table)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+func isMdDevice(name string) bool {
+	return sysfsExists(filepath.Join("class/block", name, "md/level"))
+}
+
+// Every member of the array has an md/dev-<name> directory with a block
+// symlink pointing at the member device.
+func mdMembers(name string) []string {
+	matches, _ := filepath.Glob(filepath.Join(sysfsRoot, "class/block", name, "md/dev-*/block"))
+	members := []string{}
+	for _, match := range matches {
+		realPath, err := filepath.EvalSymlinks(match)
+		if err != nil {
+			continue
+		}
+		members = append(members, filepath.Base(realPath))
+	}
+	sort.Strings(members)
+	return members
+}
+
+// An array can only use as much of each member as the smallest one has,
+// so this has to wait until every member has been grown.
+func growMdArray(name string, dryRun bool) {
+	log.Printf("Growing md array %s to use all of its members\n", devicePath(name))
+	safeRun([]string{"mdadm", "--grow", devicePath(name), "--size=max"}, dryRun)
+}
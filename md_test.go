@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func addFakeMdDevice(t *testing.T, name string, level string, members ...string) {
+	addFakeDisk(t, name)
+	writeSysfsFile(t, filepath.Join("class/block", name, "md/level"), level)
+	for _, member := range members {
+		memberDir := filepath.Join(sysfsRoot, "class/block", name, "md", "dev-"+member)
+		assert.NilError(t, os.MkdirAll(memberDir, 0755))
+		assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, "class/block", member), filepath.Join(memberDir, "block")))
+	}
+}
+
+func TestMdMembers(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1")
+	addFakeDisk(t, "nvme2n1", "nvme2n1p1")
+	addFakeDisk(t, "nvme3n1")
+	addFakeMdDevice(t, "md0", "raid0", "nvme2n1p1", "nvme1n1p1", "nvme3n1")
+	addFakeDmDevice(t, "dm-0", "vg-fast", "LVM-abc", "md0")
+
+	assert.Equal(t, isMdDevice("md0"), true)
+	assert.Equal(t, isMdDevice("nvme1n1"), false)
+	assert.DeepEqual(t, mdMembers("md0"), []string{"nvme1n1p1", "nvme2n1p1", "nvme3n1"})
+	assert.DeepEqual(t, leafDevices("dm-0"), []string{"nvme1n1p1", "nvme2n1p1", "nvme3n1"})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var procMountInfo = "/proc/self/mountinfo"
+
+// One line of /proc/self/mountinfo, see proc(5)
+type mountInfo struct {
+	ID           int
+	ParentID     int
+	Major        uint32
+	Minor        uint32
+	Root         string
+	MountPoint   string
+	Options      string
+	FSType       string
+	Source       string
+	SuperOptions string
+}
+
+func (m mountInfo) DeviceNumber() string {
+	return fmt.Sprintf("%d:%d", m.Major, m.Minor)
+}
+
+// The kernel escapes space, tab, newline and backslash as octal (\040)
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
+
+func parseMountInfoLine(line string) (mountInfo, error) {
+	fields := strings.Fields(line)
+	// There are a variable number of optional fields, terminated by a lone "-"
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator == -1 || len(fields) < separator+3 {
+		return mountInfo{}, fmt.Errorf("malformed mountinfo line: %q", line)
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("bad mount id in mountinfo line %q: %v", line, err)
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("bad parent id in mountinfo line %q: %v", line, err)
+	}
+	var major, minor uint32
+	if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+		return mountInfo{}, fmt.Errorf("bad major:minor in mountinfo line %q: %v", line, err)
+	}
+	mount := mountInfo{
+		ID:         id,
+		ParentID:   parentID,
+		Major:      major,
+		Minor:      minor,
+		Root:       unescapeMountPath(fields[3]),
+		MountPoint: unescapeMountPath(fields[4]),
+		Options:    fields[5],
+		FSType:     fields[separator+1],
+		Source:     unescapeMountPath(fields[separator+2]),
+	}
+	if len(fields) > separator+3 {
+		mount.SuperOptions = fields[separator+3]
+	}
+	return mount, nil
+}
+
+func parseMountInfo(contents string) ([]mountInfo, error) {
+	mounts := []mountInfo{}
+	for _, line := range strings.Split(contents, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		mount, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	contents, err := ioutil.ReadFile(procMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(string(contents))
+}
+
+func isBetterCanonicalMount(candidate mountInfo, current mountInfo) bool {
+	// A mount of the whole filesystem beats a bind mount of some subdirectory
+	if (candidate.Root == "/") != (current.Root == "/") {
+		return candidate.Root == "/"
+	}
+	// Otherwise go with whatever was mounted first
+	return candidate.ID < current.ID
+}
+
+// Collapses bind mounts and repeated mounts of the same filesystem down
+// to one canonical mount per superblock, keyed by major:minor.
+func canonicalMounts(mounts []mountInfo) map[string]mountInfo {
+	canonical := map[string]mountInfo{}
+	for _, mount := range mounts {
+		key := mount.DeviceNumber()
+		if current, ok := canonical[key]; !ok || isBetterCanonicalMount(mount, current) {
+			canonical[key] = mount
+		}
+	}
+	return canonical
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testMountInfo = `22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+25 22 0:5 / /dev rw,nosuid shared:2 - devtmpfs devtmpfs rw,size=4010512k
+40 22 259:2 / /var/lib/docker rw,relatime shared:20 - xfs /dev/nvme1n1 rw,attr2,inode64
+612 40 259:2 /volumes/abc /var/lib/kubelet/pods/abc/volumes/my\040data rw,relatime shared:20 - xfs /dev/nvme1n1 rw,attr2,inode64
+613 22 259:1 /home /srv/home rw,relatime master:1 - ext4 /dev/nvme0n1p1 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(testMountInfo)
+	assert.NilError(t, err)
+	assert.Equal(t, len(mounts), 5)
+	assert.DeepEqual(t, mounts[3], mountInfo{
+		ID:           612,
+		ParentID:     40,
+		Major:        259,
+		Minor:        2,
+		Root:         "/volumes/abc",
+		MountPoint:   "/var/lib/kubelet/pods/abc/volumes/my data",
+		Options:      "rw,relatime",
+		FSType:       "xfs",
+		Source:       "/dev/nvme1n1",
+		SuperOptions: "rw,attr2,inode64",
+	})
+
+	_, err = parseMountInfo("22 1 259:1 / / rw,relatime shared:1 ext4 /dev/nvme0n1p1 rw")
+	assert.ErrorContains(t, err, "malformed mountinfo line")
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	assert.Equal(t, unescapeMountPath(`/mnt/my\040disk`), "/mnt/my disk")
+	assert.Equal(t, unescapeMountPath(`/mnt/back\134slash\011tab`), "/mnt/back\\slash\ttab")
+	assert.Equal(t, unescapeMountPath(`/mnt/trailing\04`), `/mnt/trailing\04`)
+}
+
+func TestCanonicalMounts(t *testing.T) {
+	mounts, err := parseMountInfo(testMountInfo)
+	assert.NilError(t, err)
+	canonical := canonicalMounts(mounts)
+	assert.Equal(t, len(canonical), 3)
+	assert.Equal(t, canonical["259:1"].MountPoint, "/")
+	assert.Equal(t, canonical["259:2"].MountPoint, "/var/lib/docker")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ebsNvmeModel = "Amazon Elastic Block Store"
+
+// EBS puts the volume ID in the NVMe serial number, minus the dash
+func ebsVolumeIDFromSerial(serial string) string {
+	serial = strings.TrimSpace(serial)
+	if strings.HasPrefix(serial, "vol-") {
+		return serial
+	}
+	if strings.HasPrefix(serial, "vol") {
+		return "vol-" + serial[len("vol"):]
+	}
+	return ""
+}
+
+func findNvmeEbsDisksFromSysfs() map[string]string {
+	disks := map[string]string{}
+	matches, _ := filepath.Glob(filepath.Join(sysfsRoot, "block", "nvme*"))
+	for _, match := range matches {
+		disk := filepath.Base(match)
+		model, err := readSysfsString(filepath.Join("block", disk, "device/model"))
+		if err != nil || model != ebsNvmeModel {
+			continue
+		}
+		serial, err := readSysfsString(filepath.Join("block", disk, "device/serial"))
+		if err != nil {
+			continue
+		}
+		if volumeID := ebsVolumeIDFromSerial(serial); volumeID != "" {
+			disks[volumeID] = disk
+		}
+	}
+	return disks
+}
+
+func findNvmeEbsDisksFromUdev() map[string]string {
+	disks := map[string]string{}
+	prefix := "nvme-" + strings.Replace(ebsNvmeModel, " ", "_", -1) + "_"
+	matches, _ := filepath.Glob(filepath.Join(devRoot, "disk/by-id", prefix+"vol*"))
+	for _, match := range matches {
+		name := filepath.Base(match)
+		if strings.Contains(name, "-part") {
+			continue
+		}
+		target, err := os.Readlink(match)
+		if err != nil {
+			continue
+		}
+		if volumeID := ebsVolumeIDFromSerial(strings.TrimPrefix(name, prefix)); volumeID != "" {
+			disks[volumeID] = filepath.Base(target)
+		}
+	}
+	return disks
+}
+
+// Maps EBS volume IDs to the kernel name of the NVMe disk backing them.
+// Nitro doesn't enumerate NVMe devices in attachment order, so this is
+// the only reliable way to know which disk is which.
+func findNvmeEbsDisks() map[string]string {
+	disks := findNvmeEbsDisksFromSysfs()
+	if len(disks) == 0 {
+		disks = findNvmeEbsDisksFromUdev()
+	}
+	return disks
+}
+
+func resolveEbsLinuxDevice(ebs ebsBlockDevice) (string, error) {
+	if disk, ok := findNvmeEbsDisks()[ebs.VolumeID]; ok {
+		log.Printf("%s is attached as NVMe device /dev/%s", ebs.VolumeID, disk)
+		return "/dev/" + disk, nil
+	}
+	if isXenInstance() {
+		return mapEbsDeviceToLinuxDevice(ebs.Device)
+	}
+	return "", fmt.Errorf("couldn't find a linux device for %s (attached as %s)", ebs.VolumeID, ebs.Device)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestEbsVolumeIDFromSerial(t *testing.T) {
+	assert.Equal(t, ebsVolumeIDFromSerial("vol0123456789abcdef0   "), "vol-0123456789abcdef0")
+	assert.Equal(t, ebsVolumeIDFromSerial("vol-0123456789abcdef0"), "vol-0123456789abcdef0")
+	assert.Equal(t, ebsVolumeIDFromSerial("AWS1234567890ABCDEF"), "")
+}
+
+func TestFindNvmeEbsDisks(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme0n1", "nvme0n1p1")
+	addFakeDisk(t, "nvme1n1")
+	addFakeDisk(t, "nvme2n1")
+	writeSysfsFile(t, "block/nvme0n1/device/model", ebsNvmeModel)
+	writeSysfsFile(t, "block/nvme0n1/device/serial", "vol0aaaaaaaaaaaaaaaa")
+	writeSysfsFile(t, "block/nvme1n1/device/model", ebsNvmeModel)
+	writeSysfsFile(t, "block/nvme1n1/device/serial", "vol0bbbbbbbbbbbbbbbb")
+	writeSysfsFile(t, "block/nvme2n1/device/model", "Amazon EC2 NVMe Instance Storage")
+	writeSysfsFile(t, "block/nvme2n1/device/serial", "AWS0123456789")
+
+	assert.DeepEqual(t, findNvmeEbsDisks(), map[string]string{
+		"vol-0aaaaaaaaaaaaaaaa": "nvme0n1",
+		"vol-0bbbbbbbbbbbbbbbb": "nvme1n1",
+	})
+
+	device, err := resolveEbsLinuxDevice(ebsBlockDevice{Device: "/dev/sdf", VolumeID: "vol-0bbbbbbbbbbbbbbbb"})
+	assert.NilError(t, err)
+	assert.Equal(t, device, "/dev/nvme1n1")
+
+	_, err = resolveEbsLinuxDevice(ebsBlockDevice{Device: "/dev/sdg", VolumeID: "vol-0cccccccccccccccc"})
+	assert.ErrorContains(t, err, "couldn't find a linux device")
+}
+
+func TestFindNvmeEbsDisksFromUdev(t *testing.T) {
+	defer useFakeSysfs(t)()
+	byID := filepath.Join(devRoot, "disk/by-id")
+	assert.NilError(t, os.MkdirAll(byID, 0755))
+	assert.NilError(t, os.Symlink("../../nvme3n1", filepath.Join(byID, "nvme-Amazon_Elastic_Block_Store_vol0ddddddddddddddddd")))
+	assert.NilError(t, os.Symlink("../../nvme3n1p1", filepath.Join(byID, "nvme-Amazon_Elastic_Block_Store_vol0ddddddddddddddddd-part1")))
+
+	assert.DeepEqual(t, findNvmeEbsDisks(), map[string]string{
+		"vol-0ddddddddddddddddd": "nvme3n1",
+	})
+}
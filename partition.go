@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Partitions get their ends aligned to 1MiB, like every partitioning tool does
+const partitionAlignment = 1 << 20
+
+// From linux/blkpg.h and linux/fs.h
+const (
+	blkpgIoctl           = 0x1269
+	blkpgAddPartition    = 1
+	blkpgResizePartition = 3
+	blkrrpartIoctl       = 0x125f
+)
+
+// A disk (or disk image) with a partition table on it
+type partitionedDisk interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Where a partition is on disk, in sectors
+type partitionExtent struct {
+	Start   uint64
+	Sectors uint64
+}
+
+type partitionNotLastError struct {
+	Number int
+	Next   int
+}
+
+func (e *partitionNotLastError) Error() string {
+	return fmt.Sprintf("partition %d is followed by partition %d, so it can't be grown", e.Number, e.Next)
+}
+
+// There's no room after the last partition for a new one, which is to be
+// expected until the disk has grown.
+type noFreeSpaceError struct {
+	Reason string
+}
+
+func (e *noFreeSpaceError) Error() string {
+	return e.Reason
+}
+
+// Rounds the last usable sector down so that the sector after the
+// partition's end lands on an alignment boundary.
+func alignedPartitionEnd(lastUsable uint64, sectorSize int64) uint64 {
+	align := uint64(partitionAlignment / sectorSize)
+	return (lastUsable+1)/align*align - 1
+}
+
+// Rounds the first free sector up to an alignment boundary
+func alignedPartitionStart(firstFree uint64, sectorSize int64) uint64 {
+	align := uint64(partitionAlignment / sectorSize)
+	return (firstFree + align - 1) / align * align
+}
+
+func diskSectorSize(disk *os.File) int64 {
+	size, err := readSysfsString(filepath.Join("class/block", filepath.Base(disk.Name()), "queue/logical_block_size"))
+	if err != nil {
+		return 512
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 512
+	}
+	return value
+}
+
+// All the MBR code counts in 512 byte sectors, as near enough every MBR
+// disk has. Anything else (like a 4KiB sector SAN LUN) is left alone.
+func checkMBRSectorSize(disk *os.File) error {
+	if sectorSize := diskSectorSize(disk); sectorSize != mbrSectorSize {
+		return fmt.Errorf("the disk has %d byte sectors, and MBR partitions can only be grown on disks with %d byte ones", sectorSize, mbrSectorSize)
+	}
+	return nil
+}
+
+func diskTotalSectors(disk *os.File, sectorSize int64) (uint64, error) {
+	size, err := disk.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(size / sectorSize), nil
+}
+
+// Grows a partition in whichever kind of partition table the disk has,
+// returning where the partition was and where it is now.
+func growPartitionTable(disk *os.File, number int, dryRun bool) (partitionExtent, partitionExtent, error) {
+	sectorSize := diskSectorSize(disk)
+	totalSectors, err := diskTotalSectors(disk, sectorSize)
+	if err != nil {
+		return partitionExtent{}, partitionExtent{}, err
+	}
+	mbr, err := readMBR(disk)
+	if err != nil {
+		return partitionExtent{}, partitionExtent{}, err
+	}
+	if mbr.IsProtective() {
+		return growGPTPartition(disk, totalSectors, sectorSize, number, dryRun)
+	}
+	if err := checkMBRSectorSize(disk); err != nil {
+		return partitionExtent{}, partitionExtent{}, err
+	}
+	if number > 4 {
+		return growMBRLogicalPartition(disk, totalSectors, number, dryRun)
+	}
+	return growMBRPartition(disk, totalSectors, number, dryRun)
+}
+
+// A logical partition can only grow as far as its extended partition goes,
+// so that needs to grow first. The kernel only knows the extended partition
+// as a tiny stub, so there's nothing to tell it about this.
+func growExtendedPartition(disk *os.File, device string, dryRun bool) {
+	if err := checkMBRSectorSize(disk); err != nil {
+		log.Panicf("Couldn't grow the extended partition on %s: %v", device, err)
+	}
+	totalSectors, err := diskTotalSectors(disk, diskSectorSize(disk))
+	if err != nil {
+		log.Panicf("Couldn't get the size of %s: %v", device, err)
+	}
+	number, before, after, err := growMBRExtendedPartition(disk, totalSectors, dryRun)
+	if err != nil {
+		log.Panicf("Couldn't grow the extended partition on %s: %v", device, err)
+	}
+	if after.Sectors <= before.Sectors {
+		log.Printf("Extended partition %d on %s already fills the disk", number, device)
+	} else if dryRun {
+		log.Printf("Would grow extended partition %d on %s from %d to %d sectors", number, device, before.Sectors, after.Sectors)
+	} else {
+		log.Printf("Grew extended partition %d on %s from %d to %d sectors", number, device, before.Sectors, after.Sectors)
+	}
+}
+
+// Whether a partition is a logical one, inside an MBR extended partition
+func isLogicalPartition(partition string) bool {
+	disk, number, err := openPartitionDisk(partition, os.O_RDONLY)
+	if err != nil {
+		return false
+	}
+	defer disk.Close()
+	mbr, err := readMBR(disk)
+	return err == nil && !mbr.IsProtective() && number > 4
+}
+
+type blkpgPartition struct {
+	Start   int64
+	Length  int64
+	Number  int32
+	Devname [64]byte
+	Volname [64]byte
+}
+
+type blkpgIoctlArg struct {
+	Op      int32
+	Flags   int32
+	Datalen int32
+	Data    unsafe.Pointer
+}
+
+// arg has to stay an unsafe.Pointer until the Syscall itself, as the Go
+// stack (and so anything pointed at on it) can move before then.
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Tells the kernel about the new size of a partition. BLKPG can do this
+// while the partition is in use, BLKRRPART only works if nothing on the
+// disk is, but is worth a shot.
+func notifyKernelOfPartition(disk *os.File, number int, extent partitionExtent, sectorSize int64) error {
+	return updateKernelPartition(disk, blkpgResizePartition, number, extent, sectorSize)
+}
+
+func updateKernelPartition(disk *os.File, op int32, number int, extent partitionExtent, sectorSize int64) error {
+	info, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+	partition := blkpgPartition{
+		Start:  int64(extent.Start) * sectorSize,
+		Length: int64(extent.Sectors) * sectorSize,
+		Number: int32(number),
+	}
+	arg := blkpgIoctlArg{
+		Op:      op,
+		Datalen: int32(unsafe.Sizeof(partition)),
+		Data:    unsafe.Pointer(&partition),
+	}
+	err = ioctl(disk.Fd(), blkpgIoctl, unsafe.Pointer(&arg))
+	if err == nil {
+		return nil
+	}
+	log.Printf("BLKPG of partition %d failed (%v), trying BLKRRPART", number, err)
+	return ioctl(disk.Fd(), blkrrpartIoctl, nil)
+}
+
+func growPartition(partition string, dryRun bool) {
+	device, partitionNumber := parsePartitionIntoDeviceAndNumber(partition)
+	number, _ := strconv.Atoi(partitionNumber)
+	log.Printf("Going to grow parition %s!\n", partition)
+	flags := os.O_RDWR
+	if dryRun {
+		flags = os.O_RDONLY
+	}
+	disk, err := os.OpenFile(device, flags, 0)
+	if err != nil {
+		log.Panicf("Couldn't open %s to grow partition %d: %v", device, number, err)
+	}
+	defer disk.Close()
+	if number > 4 {
+		if mbr, err := readMBR(disk); err == nil && !mbr.IsProtective() {
+			growExtendedPartition(disk, device, dryRun)
+		}
+	}
+	before, after, err := growPartitionTable(disk, number, dryRun)
+	if err != nil {
+		log.Panicf("Couldn't grow partition %d on %s: %v", number, device, err)
+	}
+	if after.Sectors <= before.Sectors {
+		log.Printf("%s already fills the disk, nothing to grow", partition)
+		return
+	}
+	if dryRun {
+		log.Printf("Would grow %s from %d to %d sectors", partition, before.Sectors, after.Sectors)
+		return
+	}
+	log.Printf("Grew %s from %d to %d sectors", partition, before.Sectors, after.Sectors)
+	if err := disk.Sync(); err != nil {
+		log.Panicf("Couldn't sync the partition table on %s: %v", device, err)
+	}
+	if err := notifyKernelOfPartition(disk, number, after, diskSectorSize(disk)); err != nil {
+		log.Panicf("Grew partition %d on %s, but couldn't tell the kernel about it: %v", number, device, err)
+	}
+}
+
+// Opens the disk a partition is on, returning it and the partition number
+func openPartitionDisk(partition string, flags int) (*os.File, int, error) {
+	device, partitionNumber := parsePartitionIntoDeviceAndNumber(partition)
+	number, _ := strconv.Atoi(partitionNumber)
+	disk, err := os.OpenFile(filepath.Join(devRoot, filepath.Base(device)), flags, 0)
+	return disk, number, err
+}
+
+// An MBR can't describe anything past 2TiB (with 512 byte sectors), so
+// there's no point paying for a bigger disk than that. Returns how big the
+// disk under a partition can usefully get in GiB (0 for no limit), or
+// whether it is going to be converted to GPT to get rid of the limit.
+func mbrSizeLimit(partition string, convertToGPT bool) (int64, bool, error) {
+	disk, number, err := openPartitionDisk(partition, os.O_RDONLY)
+	if err != nil {
+		log.Printf("Couldn't open the disk under %s to check its partition table: %v", partition, err)
+		return 0, false, nil
+	}
+	defer disk.Close()
+	table, err := readMBR(disk)
+	if err != nil {
+		log.Printf("Couldn't read the partition table under %s: %v", partition, err)
+		return 0, false, nil
+	}
+	if table.IsProtective() {
+		return 0, false, nil
+	}
+	convertErr := checkMBRConvertible(disk, table)
+	if convertErr == nil {
+		convertErr = checkMBRSectorSize(disk)
+	}
+	if convertToGPT {
+		if convertErr != nil {
+			return 0, false, fmt.Errorf("can't convert the MBR under %s to GPT: %v", partition, convertErr)
+		}
+		return 0, true, nil
+	}
+	maxSize := int64(mbrUsableSizeLimit(table, number) >> 30)
+	if convertErr == nil {
+		log.Printf("%s is on an MBR disk, so it can't use more than %dGiB. --convert-mbr-to-gpt would lift that limit", partition, maxSize)
+	} else {
+		log.Printf("%s is on an MBR disk, so it can't use more than %dGiB (and can't be converted to GPT: %v)", partition, maxSize, convertErr)
+	}
+	return maxSize, false, nil
+}
+
+func convertPartitionTable(partition string, dryRun bool) {
+	if dryRun {
+		log.Printf("Would convert the MBR under %s to GPT", partition)
+		return
+	}
+	disk, _, err := openPartitionDisk(partition, os.O_RDWR)
+	if err != nil {
+		log.Panicf("Couldn't open the disk under %s to convert it to GPT: %v", partition, err)
+	}
+	defer disk.Close()
+	totalSectors, err := diskTotalSectors(disk, mbrSectorSize)
+	if err != nil {
+		log.Panicf("Couldn't get the size of the disk under %s: %v", partition, err)
+	}
+	if err := convertMBRToGPT(disk, totalSectors); err != nil {
+		log.Panicf("Couldn't convert the MBR under %s to GPT: %v", partition, err)
+	}
+	if err := disk.Sync(); err != nil {
+		log.Panicf("Couldn't sync the new GPT under %s: %v", partition, err)
+	}
+	log.Printf("Converted the MBR under %s to GPT", partition)
+}
+
+// Checks a partition can be grown without changing anything, since this
+// needs to be found out before paying for a bigger volume.
+func checkPartitionGrowable(partition string) error {
+	disk, number, err := openPartitionDisk(partition, os.O_RDONLY)
+	if err != nil {
+		log.Printf("Couldn't open the disk under %s to check it can grow: %v", partition, err)
+		return nil
+	}
+	defer disk.Close()
+	sectorSize := diskSectorSize(disk)
+	totalSectors, err := diskTotalSectors(disk, sectorSize)
+	if err != nil {
+		return err
+	}
+	if isLogicalPartition(partition) {
+		if err := checkMBRSectorSize(disk); err != nil {
+			return err
+		}
+		if _, _, _, err := growMBRExtendedPartition(disk, totalSectors, true); err != nil {
+			return err
+		}
+	}
+	_, _, err = growPartitionTable(disk, number, true)
+	return err
+}
+
+// Partitions of disks whose names end in a number get a "p" in between
+func partitionDevicePath(disk string, number int) string {
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", disk, number)
+	}
+	return fmt.Sprintf("%s%d", disk, number)
+}
+
+// Creates a new partition in the space after the last one on the disk
+// under partition, returning its path once the kernel knows about it.
+func addSpilloverPartition(partition string, forLvm bool, dryRun bool) string {
+	device, _ := parsePartitionIntoDeviceAndNumber(partition)
+	flags := os.O_RDWR
+	if dryRun {
+		flags = os.O_RDONLY
+	}
+	disk, _, err := openPartitionDisk(partition, flags)
+	if err != nil {
+		log.Panicf("Couldn't open %s to add a partition: %v", device, err)
+	}
+	defer disk.Close()
+	sectorSize := diskSectorSize(disk)
+	totalSectors, err := diskTotalSectors(disk, sectorSize)
+	if err != nil {
+		log.Panicf("Couldn't get the size of %s: %v", device, err)
+	}
+	number, extent, err := addPartitionAfterLast(disk, totalSectors, sectorSize, forLvm, dryRun)
+	if err != nil {
+		log.Panicf("Couldn't add a partition to %s: %v", device, err)
+	}
+	newPartition := partitionDevicePath(device, number)
+	if dryRun {
+		log.Printf("Would create %s with %d sectors", newPartition, extent.Sectors)
+		return newPartition
+	}
+	log.Printf("Created %s with %d sectors", newPartition, extent.Sectors)
+	if err := disk.Sync(); err != nil {
+		log.Panicf("Couldn't sync the partition table on %s: %v", device, err)
+	}
+	if err := updateKernelPartition(disk, blkpgAddPartition, number, extent, sectorSize); err != nil {
+		log.Panicf("Created partition %d on %s, but couldn't tell the kernel about it: %v", number, device, err)
+	}
+	// udev makes the device node in its own time
+	for i := 0; i < 30 && !fileExists(newPartition); i++ {
+		time.Sleep(time.Second)
+	}
+	if !fileExists(newPartition) {
+		log.Panicf("%s never showed up", newPartition)
+	}
+	return newPartition
+}
+
+func addPartitionAfterLast(disk *os.File, totalSectors uint64, sectorSize int64, forLvm bool, dryRun bool) (int, partitionExtent, error) {
+	mbr, err := readMBR(disk)
+	if err != nil {
+		return 0, partitionExtent{}, err
+	}
+	// Linux filesystem, or Linux LVM
+	partitionType := byte(0x83)
+	if forLvm {
+		partitionType = 0x8e
+	}
+	if mbr.IsProtective() {
+		return addGPTPartition(disk, totalSectors, sectorSize, mbrTypeToGPTType[partitionType], dryRun)
+	}
+	if err := checkMBRSectorSize(disk); err != nil {
+		return 0, partitionExtent{}, err
+	}
+	return addMBRPartition(disk, totalSectors, partitionType, dryRun)
+}
+
+// Makes sure the partition table has an entry free for a spillover
+// partition, before paying for a bigger volume to put in it. The space
+// itself won't be there until the volume has grown.
+func checkSpilloverPartition(partition string) error {
+	disk, _, err := openPartitionDisk(partition, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	sectorSize := diskSectorSize(disk)
+	totalSectors, err := diskTotalSectors(disk, sectorSize)
+	if err != nil {
+		return err
+	}
+	_, _, err = addPartitionAfterLast(disk, totalSectors, sectorSize, false, true)
+	if _, ok := err.(*noFreeSpaceError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testSectorSize = 512
+const mib = 1 << 20
+
+var testLinuxFilesystemGUID = [16]byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+
+func createDiskImage(t *testing.T, size int64) *os.File {
+	image, err := ioutil.TempFile("", "resize-thyself-disk")
+	assert.NilError(t, err)
+	assert.NilError(t, image.Truncate(size))
+	return image
+}
+
+func removeDiskImage(image *os.File) {
+	image.Close()
+	os.Remove(image.Name())
+}
+
+// Lays down a protective MBR and a GPT with 128 entries, the way sgdisk would
+func createGPTImage(t *testing.T, size int64, partitions ...partitionExtent) *os.File {
+	image := createDiskImage(t, size)
+	totalSectors := uint64(size / testSectorSize)
+	mbr := mbrTable{Sector: make([]byte, mbrSectorSize)}
+	mbr.Sector[510], mbr.Sector[511] = 0x55, 0xaa
+	mbr.Entries[0] = mbrEntry{Type: mbrProtectiveType, FirstLBA: 1, Sectors: uint32(totalSectors - 1)}
+	assert.NilError(t, writeMBR(image, mbr))
+
+	table := gptTable{
+		Header: gptHeader{
+			Revision:                 0x00010000,
+			HeaderSize:               gptHeaderSize,
+			FirstUsableLBA:           34,
+			NumberOfPartitionEntries: 128,
+			SizeOfPartitionEntry:     128,
+		},
+		Entries: make([]byte, 128*128),
+	}
+	copy(table.Header.Signature[:], gptSignature)
+	for i, extent := range partitions {
+		table.SetEntry(i+1, gptEntry{
+			TypeGUID:   testLinuxFilesystemGUID,
+			UniqueGUID: [16]byte{byte(i + 1)},
+			StartLBA:   extent.Start,
+			EndLBA:     extent.Start + extent.Sectors - 1,
+		})
+	}
+	assert.NilError(t, writeGPT(image, table, totalSectors, testSectorSize))
+	return image
+}
+
+func createMBRImage(t *testing.T, size int64, partitions ...mbrEntry) *os.File {
+	image := createDiskImage(t, size)
+	mbr := mbrTable{Sector: make([]byte, mbrSectorSize)}
+	mbr.Sector[0] = 0xeb // Something for the boot code, which should be left alone
+	mbr.Sector[510], mbr.Sector[511] = 0x55, 0xaa
+	copy(mbr.Entries[:], partitions)
+	assert.NilError(t, writeMBR(image, mbr))
+	return image
+}
+
+func TestGrowGPTPartition(t *testing.T) {
+	image := createGPTImage(t, 16*mib, partitionExtent{Start: 2048, Sectors: 8192}, partitionExtent{Start: 10240, Sectors: 16384})
+	defer removeDiskImage(image)
+	// The EBS volume grew from 16MiB to 64MiB
+	assert.NilError(t, image.Truncate(64*mib))
+
+	before, after, err := growPartitionTable(image, 2, false)
+	assert.NilError(t, err)
+	assert.Equal(t, before, partitionExtent{Start: 10240, Sectors: 16384})
+	// The last 1MiB can't be used because of the backup GPT and alignment
+	assert.Equal(t, after, partitionExtent{Start: 10240, Sectors: 63*2048 - 10240})
+
+	primary, err := readGPT(image, testSectorSize)
+	assert.NilError(t, err)
+	assert.Equal(t, primary.Header.AlternateLBA, uint64(64*2048-1))
+	assert.Equal(t, primary.Header.LastUsableLBA, uint64(64*2048-34))
+	assert.Equal(t, primary.Entry(2).EndLBA, uint64(63*2048-1))
+	assert.Equal(t, primary.Entry(1).EndLBA, uint64(2048+8192-1))
+
+	backup, err := readGPTAt(image, 64*2048-1, testSectorSize)
+	assert.NilError(t, err)
+	assert.Equal(t, backup.Header.MyLBA, uint64(64*2048-1))
+	assert.Equal(t, backup.Header.AlternateLBA, uint64(1))
+	assert.Equal(t, backup.Header.PartitionEntryLBA, uint64(64*2048-33))
+	assert.Assert(t, bytes.Equal(backup.Entries, primary.Entries))
+
+	mbr, err := readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.Entries[0].Sectors, uint32(64*2048-1))
+
+	// Running it again has nothing left to do
+	before, after, err = growPartitionTable(image, 2, false)
+	assert.NilError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestGrowGPTPartitionDryRun(t *testing.T) {
+	image := createGPTImage(t, 16*mib, partitionExtent{Start: 2048, Sectors: 8192})
+	defer removeDiskImage(image)
+	assert.NilError(t, image.Truncate(32*mib))
+	original, err := ioutil.ReadFile(image.Name())
+	assert.NilError(t, err)
+
+	before, after, err := growPartitionTable(image, 1, true)
+	assert.NilError(t, err)
+	assert.Equal(t, before.Sectors, uint64(8192))
+	assert.Equal(t, after.Sectors, uint64(31*2048-2048))
+
+	unchanged, err := ioutil.ReadFile(image.Name())
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(original, unchanged))
+}
+
+func TestGrowGPTPartitionNotLast(t *testing.T) {
+	image := createGPTImage(t, 16*mib, partitionExtent{Start: 2048, Sectors: 8192}, partitionExtent{Start: 10240, Sectors: 2048})
+	defer removeDiskImage(image)
+	assert.NilError(t, image.Truncate(32*mib))
+
+	_, _, err := growPartitionTable(image, 1, false)
+	assert.Error(t, err, "partition 1 is followed by partition 2, so it can't be grown")
+	_, _, err = growPartitionTable(image, 3, false)
+	assert.Error(t, err, "partition 3 doesn't exist in the GPT")
+}
+
+func TestGrowGPTPartitionCorrupt(t *testing.T) {
+	image := createGPTImage(t, 16*mib, partitionExtent{Start: 2048, Sectors: 8192})
+	defer removeDiskImage(image)
+	_, err := image.WriteAt([]byte{0xff}, 2*testSectorSize)
+	assert.NilError(t, err)
+
+	_, _, err = growPartitionTable(image, 1, false)
+	assert.Error(t, err, "GPT partition entries checksum doesn't match")
+}
+
+func TestGrowMBRPartition(t *testing.T) {
+	image := createMBRImage(t, 16*mib,
+		mbrEntry{Type: 0x82, FirstLBA: 2048, Sectors: 4096},
+		mbrEntry{Status: 0x80, Type: 0x83, FirstLBA: 6144, Sectors: 20480},
+	)
+	defer removeDiskImage(image)
+	assert.NilError(t, image.Truncate(64*mib))
+
+	before, after, err := growPartitionTable(image, 2, false)
+	assert.NilError(t, err)
+	assert.Equal(t, before, partitionExtent{Start: 6144, Sectors: 20480})
+	assert.Equal(t, after, partitionExtent{Start: 6144, Sectors: 64*2048 - 6144})
+
+	mbr, err := readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.Sector[0], byte(0xeb))
+	assert.Equal(t, mbr.Entries[1].Sectors, uint32(64*2048-6144))
+	assert.Equal(t, mbr.Entries[1].Status, byte(0x80))
+	assert.Equal(t, mbr.Entries[0].Sectors, uint32(4096))
+
+	_, _, err = growPartitionTable(image, 1, false)
+	assert.Error(t, err, "partition 1 is followed by partition 2, so it can't be grown")
+}
+
+func TestGrowMBRPartition4KSectors(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1", "nvme1n1p5")
+	writeSysfsFile(t, "class/block/nvme1n1/queue/logical_block_size", "4096")
+	image := createMBRImage(t, 16*mib,
+		mbrEntry{Type: 0x83, FirstLBA: 2048, Sectors: 4096},
+		mbrEntry{Type: 0x05, FirstLBA: 6144, Sectors: 4096},
+	)
+	writeTestEBR(t, image, 6144, mbrEntry{Type: 0x83, FirstLBA: 2048, Sectors: 2048}, mbrEntry{})
+	placeDiskImage(t, image, "nvme1n1")
+
+	// The partition table counts in 512 byte sectors, so these would end
+	// up eight times past the end of the disk
+	err := checkPartitionGrowable("/dev/nvme1n1p1")
+	assert.Error(t, err, "the disk has 4096 byte sectors, and MBR partitions can only be grown on disks with 512 byte ones")
+	err = checkPartitionGrowable("/dev/nvme1n1p5")
+	assert.Error(t, err, "the disk has 4096 byte sectors, and MBR partitions can only be grown on disks with 512 byte ones")
+}
+
+func TestMBRUsableSizeLimit(t *testing.T) {
+	table := mbrTable{}
+	table.Entries[0] = mbrEntry{Type: 0x83, FirstLBA: 2048, Sectors: 4096}
+	table.Entries[1] = mbrEntry{Type: 0x05, FirstLBA: 8192, Sectors: 4096}
+	assert.Equal(t, mbrUsableSizeLimit(table, 1), uint64(2048+0xffffffff)*512)
+	// Logical partitions are limited by their extended partition
+	assert.Equal(t, mbrUsableSizeLimit(table, 5), uint64(8192+0xffffffff)*512)
+	assert.Equal(t, mbrUsableSizeLimit(table, 1)>>30, uint64(2048))
+}
+
+func TestConvertMBRToGPT(t *testing.T) {
+	image := createMBRImage(t, 16*mib,
+		mbrEntry{Type: 0x82, FirstLBA: 2048, Sectors: 4096},
+		mbrEntry{Status: 0x80, Type: 0x83, FirstLBA: 6144, Sectors: 32*mib/512 - 6144},
+	)
+	defer removeDiskImage(image)
+	// The last partition used to run to the end of the disk, the grown
+	// volume leaves room for the backup GPT.
+	assert.NilError(t, image.Truncate(64*mib))
+	mbr, err := readMBR(image)
+	assert.NilError(t, err)
+	assert.NilError(t, checkMBRConvertible(image, mbr))
+
+	assert.NilError(t, convertMBRToGPT(image, 64*mib/512))
+	mbr, err = readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.IsProtective(), true)
+	assert.Equal(t, mbr.Sector[0], byte(0xeb))
+	assert.Equal(t, mbr.Entries[0].Sectors, uint32(64*mib/512-1))
+
+	table, err := readGPT(image, testSectorSize)
+	assert.NilError(t, err)
+	swap := table.Entry(1)
+	assert.Equal(t, swap.StartLBA, uint64(2048))
+	assert.Equal(t, swap.EndLBA, uint64(6143))
+	assert.Equal(t, swap.TypeGUID, mbrTypeToGPTType[0x82])
+	assert.Equal(t, swap.Attributes, uint64(0))
+	root := table.Entry(2)
+	assert.Equal(t, root.StartLBA, uint64(6144))
+	assert.Equal(t, root.EndLBA, uint64(32*mib/512-1))
+	assert.Equal(t, root.TypeGUID, testLinuxFilesystemGUID)
+	assert.Equal(t, root.Attributes, uint64(gptLegacyBootableAttribute))
+	assert.Assert(t, root.UniqueGUID != swap.UniqueGUID)
+
+	// And it can be grown as a GPT partition now
+	_, after, err := growPartitionTable(image, 2, false)
+	assert.NilError(t, err)
+	assert.Equal(t, after, partitionExtent{Start: 6144, Sectors: 63*2048 - 6144})
+}
+
+func TestCheckMBRConvertible(t *testing.T) {
+	image := createMBRImage(t, 16*mib,
+		mbrEntry{Type: 0x83, FirstLBA: 2048, Sectors: 4096},
+		mbrEntry{Type: 0x05, FirstLBA: 6144, Sectors: 4096},
+	)
+	defer removeDiskImage(image)
+	mbr, err := readMBR(image)
+	assert.NilError(t, err)
+	assert.Error(t, checkMBRConvertible(image, mbr), "partition 2 is an extended partition, which can't be converted")
+
+	mbr.Entries[1] = mbrEntry{}
+	// Something like GRUB's core.img living after the MBR
+	assert.NilError(t, writeAt(image, []byte{0x52, 0xe8}, 4*512))
+	assert.Error(t, checkMBRConvertible(image, mbr), "there is something (probably a bootloader) in the sectors a GPT would need")
+}
+
+// Adds an EBR, describing one logical partition and linking to the next
+func writeTestEBR(t *testing.T, image *os.File, lba uint64, logical mbrEntry, next mbrEntry) {
+	ebr := mbrTable{LBA: lba, Sector: make([]byte, mbrSectorSize)}
+	ebr.Sector[510], ebr.Sector[511] = 0x55, 0xaa
+	ebr.Entries[0], ebr.Entries[1] = logical, next
+	assert.NilError(t, writeMBR(image, ebr))
+}
+
+func TestGrowMBRLogicalPartition(t *testing.T) {
+	image := createMBRImage(t, 16*mib,
+		mbrEntry{Status: 0x80, Type: 0x83, FirstLBA: 2048, Sectors: 4096},
+		mbrEntry{Type: 0x05, FirstLBA: 6144, Sectors: 32*mib/512 - 6144},
+	)
+	defer removeDiskImage(image)
+	// xvda5 at 8192 and xvda6 at 14336, each with their EBR 2048 sectors before them
+	writeTestEBR(t, image, 6144, mbrEntry{Type: 0x82, FirstLBA: 2048, Sectors: 4096}, mbrEntry{Type: 0x05, FirstLBA: 6144, Sectors: 26624})
+	writeTestEBR(t, image, 12288, mbrEntry{Type: 0x83, FirstLBA: 2048, Sectors: 32*mib/512 - 14336}, mbrEntry{})
+	assert.NilError(t, image.Truncate(64*mib))
+
+	// A dry run shows both, without writing either
+	number, before, after, err := growMBRExtendedPartition(image, 64*mib/512, true)
+	assert.NilError(t, err)
+	assert.Equal(t, number, 2)
+	assert.Equal(t, before, partitionExtent{Start: 6144, Sectors: 32*mib/512 - 6144})
+	assert.Equal(t, after, partitionExtent{Start: 6144, Sectors: 64*mib/512 - 6144})
+	before, after, err = growPartitionTable(image, 6, true)
+	assert.NilError(t, err)
+	assert.Equal(t, before, partitionExtent{Start: 14336, Sectors: 32*mib/512 - 14336})
+	assert.Equal(t, after, partitionExtent{Start: 14336, Sectors: 64*mib/512 - 14336})
+	mbr, err := readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.Entries[1].Sectors, uint32(32*mib/512-6144))
+
+	_, _, _, err = growMBRExtendedPartition(image, 64*mib/512, false)
+	assert.NilError(t, err)
+	_, after, err = growPartitionTable(image, 6, false)
+	assert.NilError(t, err)
+	assert.Equal(t, after, partitionExtent{Start: 14336, Sectors: 64*mib/512 - 14336})
+	mbr, err = readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.Entries[1].Sectors, uint32(64*mib/512-6144))
+	assert.Equal(t, mbr.Entries[0].Sectors, uint32(4096))
+	ebrs, err := readEBRs(image, mbr.Entries[1])
+	assert.NilError(t, err)
+	assert.Equal(t, len(ebrs), 2)
+	assert.Equal(t, ebrs[0].Entries[0].Sectors, uint32(4096))
+	assert.Equal(t, ebrs[1].Entries[0].Sectors, uint32(64*mib/512-14336))
+
+	_, _, err = growPartitionTable(image, 5, false)
+	assert.Error(t, err, "partition 5 is followed by partition 6, so it can't be grown")
+}
+
+func TestAddGPTPartition(t *testing.T) {
+	image := createGPTImage(t, 16*mib, partitionExtent{Start: 2048, Sectors: 8192}, partitionExtent{Start: 10240, Sectors: 4096})
+	defer removeDiskImage(image)
+	assert.NilError(t, image.Truncate(64*mib))
+
+	number, extent, err := addGPTPartition(image, 64*mib/512, testSectorSize, mbrTypeToGPTType[0x8e], false)
+	assert.NilError(t, err)
+	assert.Equal(t, number, 3)
+	// Right after partition 2, which ends on a 1MiB boundary
+	assert.Equal(t, extent, partitionExtent{Start: 14336, Sectors: 63*2048 - 14336})
+
+	table, err := readGPT(image, testSectorSize)
+	assert.NilError(t, err)
+	entry := table.Entry(3)
+	assert.Equal(t, entry.TypeGUID, mbrTypeToGPTType[0x8e])
+	assert.Equal(t, entry.EndLBA, uint64(63*2048-1))
+	assert.Equal(t, table.Entry(2).EndLBA, uint64(14335))
+
+	_, _, err = addGPTPartition(image, 64*mib/512, testSectorSize, mbrTypeToGPTType[0x8e], false)
+	assert.Error(t, err, "there is no free space after the last partition")
+}
+
+func TestAddMBRPartition(t *testing.T) {
+	image := createMBRImage(t, 16*mib,
+		mbrEntry{Status: 0x80, Type: 0x83, FirstLBA: 2048, Sectors: 8192},
+		mbrEntry{Type: 0x82, FirstLBA: 10240, Sectors: 4096},
+	)
+	defer removeDiskImage(image)
+	assert.NilError(t, image.Truncate(64*mib))
+
+	number, extent, err := addMBRPartition(image, 64*mib/512, 0x83, true)
+	assert.NilError(t, err)
+	assert.Equal(t, number, 3)
+	assert.Equal(t, extent, partitionExtent{Start: 14336, Sectors: 64*2048 - 14336})
+	mbr, err := readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.Entries[2].IsUsed(), false)
+
+	_, _, err = addMBRPartition(image, 64*mib/512, 0x83, false)
+	assert.NilError(t, err)
+	mbr, err = readMBR(image)
+	assert.NilError(t, err)
+	assert.Equal(t, mbr.Entries[2].FirstLBA, uint32(14336))
+	assert.Equal(t, mbr.Entries[2].Type, byte(0x83))
+	assert.Equal(t, mbr.Sector[0], byte(0xeb))
+}
+
+func TestPartitionDevicePath(t *testing.T) {
+	assert.Equal(t, partitionDevicePath("/dev/nvme1n1", 3), "/dev/nvme1n1p3")
+	assert.Equal(t, partitionDevicePath("/dev/xvda", 3), "/dev/xvda3")
+}
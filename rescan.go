@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to give the kernel to notice a disk has grown, and how often to check
+var rescanTimeout = 5 * time.Minute
+var rescanPollInterval = 5 * time.Second
+
+// How the disk is attached, which decides how to get the kernel to
+// look at its size again.
+func blockDeviceBus(disk string) string {
+	switch {
+	case strings.HasPrefix(disk, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(disk, "xvd"):
+		return "xen"
+	case strings.HasPrefix(disk, "vd"):
+		return "virtio"
+	case strings.HasPrefix(disk, "sd"):
+		return "scsi"
+	}
+	return "unknown"
+}
+
+// Asks the kernel to re-read the size of a disk. Xen and virtio disks get
+// told about new sizes by the hypervisor, so there's nothing to ask.
+func rescanBlockDevice(disk string) error {
+	var rescan string
+	switch blockDeviceBus(disk) {
+	case "nvme":
+		rescan = filepath.Join("class/block", disk, "device/rescan_controller")
+	case "scsi":
+		rescan = filepath.Join("class/block", disk, "device/rescan")
+	default:
+		return nil
+	}
+	if !sysfsExists(rescan) {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(sysfsRoot, rescan), []byte("1"), 0200)
+}
+
+// The size the kernel thinks a disk is, in bytes. sysfs always counts
+// in 512 byte sectors, whatever the disk's real sector size is.
+func blockDeviceSize(disk string) (int64, error) {
+	size, err := readSysfsString(filepath.Join("class/block", disk, "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return sectors * 512, nil
+}
+
+// Rescans a disk until the kernel sees it as (at least) size bytes,
+// checking again whenever the kernel says its size changed.
+func waitForBlockDeviceSize(disk string, size int64) error {
+	listener := listenForUevents()
+	defer listener.Close()
+	deadline := time.Now().Add(rescanTimeout)
+	for {
+		if err := rescanBlockDevice(disk); err != nil {
+			log.Printf("Couldn't rescan %s: %v", disk, err)
+		}
+		current, err := blockDeviceSize(disk)
+		if err != nil {
+			return err
+		}
+		if current >= size {
+			log.Printf("The kernel sees %s as %d bytes now", disk, current)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the kernel still sees %s as %d bytes after %v, but it should be %d bytes", disk, current, rescanTimeout, size)
+		}
+		listener.WaitForCapacityChange(disk, rescanPollInterval)
+	}
+}
+
+// Waits for the kernel to notice every disk that has just been grown,
+// sizes being in GiB like EBS does them.
+func waitForBlockDeviceSizes(disks []string, sizes []int64, dryRun bool) {
+	for i, disk := range disks {
+		if dryRun {
+			log.Printf("Would rescan %s (%s) and wait for it to be %dGiB", disk, blockDeviceBus(disk), sizes[i])
+			continue
+		}
+		if err := waitForBlockDeviceSize(disk, sizes[i]<<30); err != nil {
+			log.Panicf("%s was grown, but the kernel never noticed: %v", disk, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestBlockDeviceBus(t *testing.T) {
+	assert.Equal(t, blockDeviceBus("nvme1n1"), "nvme")
+	assert.Equal(t, blockDeviceBus("xvdf"), "xen")
+	assert.Equal(t, blockDeviceBus("vdb"), "virtio")
+	assert.Equal(t, blockDeviceBus("sdf"), "scsi")
+}
+
+func TestWaitForBlockDeviceSize(t *testing.T) {
+	defer useFakeSysfs(t)()
+	oldTimeout, oldInterval := rescanTimeout, rescanPollInterval
+	rescanTimeout, rescanPollInterval = 50*time.Millisecond, time.Millisecond
+	defer func() { rescanTimeout, rescanPollInterval = oldTimeout, oldInterval }()
+	addFakeDisk(t, "sdf")
+	writeSysfsFile(t, "class/block/sdf/device/rescan", "")
+
+	// addFakeDisk makes 1GiB disks
+	assert.NilError(t, waitForBlockDeviceSize("sdf", 1<<30))
+	rescan, err := ioutil.ReadFile(filepath.Join(sysfsRoot, "class/block/sdf/device/rescan"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(rescan), "1")
+
+	err = waitForBlockDeviceSize("sdf", 2<<30)
+	assert.ErrorContains(t, err, "the kernel still sees sdf as 1073741824 bytes after 50ms, but it should be 2147483648 bytes")
+}
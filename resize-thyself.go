@@ -12,25 +12,43 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/docopt/docopt-go"
 	"log"
-	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const volumeIncreasePercent float64 = 0.2
-
 var version string
 
 func parseArgs() map[string]interface{} {
 	usage := `resize-thyself - Automatically resize a block device under pressue
 Usage:
-  resize-thyself [-v] [-d] [--threshold=<percent>] [--grow-percent=<percent>]
+  resize-thyself [-v] [-d] [--threshold=<percent>] [--inode-threshold=<percent>] [--min-free=<size>] [--target-free=<size>] [--trigger=<any|all>] [--reserved-as-used] [--strategy=<name>] [--grow-percent=<percent>] [--min-increment=<size>] [--grow-step=<size>] [--target-usage=<percent>] [--granularity=<size>] [--max-size=<size>] [--lvm-extend=<amount>] [--crypt-keyfile=<file>] [--convert-mbr-to-gpt] [--spillover] [--san [--grow-command=<command>]] [--path=<path>...]
 Options:
   --threshold=<percent>        How full should the disk be before acting? [default: 90]
+  --inode-threshold=<percent>  How many of the inodes should be used before acting? 0 to ignore inodes [default: 90]
+  --min-free=<size>            Act when there is less than this much free space, e.g. 50GiB
+  --target-free=<size>         Grow enough to have at least this much free space afterwards, e.g. 100GiB
+  --trigger=<any|all>          Act when any or all of --threshold and --min-free are crossed [default: any]
+  --reserved-as-used           Count blocks reserved for root as used [default: false]
+  --strategy=<name>            How to grow: percent, fixed (--grow-step) or target (--target-usage) [default: percent]
   --grow-percent=<percent>     How much should we grow the disk? [default: 10]
+  --min-increment=<size>       The least the percent strategy grows a disk by, 0 for no minimum [default: 1GiB]
+  --grow-step=<size>           How much the fixed strategy grows a disk by [default: 10GiB]
+  --target-usage=<percent>     How full the target strategy grows the filesystem to be [default: 70]
+  --granularity=<size>         Round new disk sizes up to a multiple of this, 0 to not round [default: 1GiB]
+  --max-size=<size>            The biggest any one volume is allowed to get (at least 1GiB), exits 2 if one that needs to grow can't [default: 1TiB]
+  --lvm-extend=<amount>        How much to lvextend logical volumes by, extents or size [default: +100%FREE]
+  --crypt-keyfile=<file>       Keyfile for LUKS2 volumes that need one to be resized
+  --convert-mbr-to-gpt         Convert MBR disks to GPT so they can grow past 2TiB [default: false]
+  --san                        Grow filesystems on iSCSI/FC SAN LUNs instead of EBS volumes [default: false]
+  --grow-command=<command>     Command to grow the LUNs under a filesystem in --san mode, given its mount point and disks
+  --spillover                  When a partition can't grow, add the new space to its LVM VG or btrfs as a new partition [default: false]
+  --path=<path>                Only resize the filesystem holding this path (repeatable)
   -v, --verbose                Be more verbose [default: false]
   -d, --dryrun                 Dry run (don't resize) [default: false]
   -h, --help                   Show this screen
@@ -65,23 +83,6 @@ func safeRun(command []string, dryrun bool) string {
 	return string(outStr)
 }
 
-func parseDfOutput(dfOutput string) (float64, error) {
-	lines := strings.Split(dfOutput, "\n")
-	// The Header is the first line, our df should be the second line
-	dfLine := lines[1]
-	parsedLine := strings.Fields(dfLine)
-	total, err := strconv.ParseFloat(parsedLine[1], 64)
-	if err != nil {
-		return 0, err
-	}
-	used, err := strconv.ParseFloat(parsedLine[2], 64)
-	if err != nil {
-		return 0, err
-	}
-	return used / total, nil
-
-}
-
 func getRegion() string {
 	sess, _ := session.NewSession()
 	md := ec2metadata.New(sess)
@@ -96,18 +97,105 @@ func getInstanceID(ec2Client *ec2.EC2) string {
 	return id
 }
 
-func getEbsBlockDevices() []string {
+type ebsBlockDevice struct {
+	Device   string
+	VolumeID string
+}
+
+func isEbsMappingName(name string) bool {
+	// Instance store volumes show up as ephemeralN, and swap is never EBS
+	return !strings.HasPrefix(name, "ephemeral") && name != "swap"
+}
+
+func normalizeEbsDeviceName(device string) string {
+	if strings.HasPrefix(device, "/dev/") {
+		return device
+	}
+	return "/dev/" + device
+}
+
+func getAttachedEbsVolumes(ec2Client *ec2.EC2, instanceID string) map[string]string {
+	attached := map[string]string{}
+	result := getEbsVolumeIDs(ec2Client, instanceID)
+	if result == nil {
+		return attached
+	}
+	for _, volume := range result.Volumes {
+		for _, attachment := range volume.Attachments {
+			if aws.StringValue(attachment.InstanceId) != instanceID {
+				continue
+			}
+			if aws.StringValue(attachment.State) != ec2.VolumeAttachmentStateAttached {
+				continue
+			}
+			attached[aws.StringValue(attachment.Device)] = aws.StringValue(volume.VolumeId)
+		}
+	}
+	return attached
+}
+
+func getMetadataBlockDevices() []string {
 	sess, _ := session.NewSession()
 	md := ec2metadata.New(sess)
-	if md.Available() {
-		mapping, _ := md.GetMetadata("block-device-mapping/root")
-		log.Printf("Metadata mapping for root: '%+v'\n", mapping)
-		// TODO: Filter only EBS, actually work, return more than the root
-		return []string{mapping}
+	if !md.Available() {
+		log.Println("ec2 metadata not available.")
+		return []string{}
 	}
-	log.Println("ec2 metadata not available.")
-	return []string{}
+	names, err := md.GetMetadata("block-device-mapping/")
+	if err != nil {
+		log.Printf("Couldn't list the metadata block device mapping: %v", err)
+		return []string{}
+	}
+	devices := []string{}
+	for _, name := range strings.Fields(names) {
+		if !isEbsMappingName(name) {
+			log.Printf("Skipping block device mapping %s, it isn't EBS", name)
+			continue
+		}
+		mapping, err := md.GetMetadata("block-device-mapping/" + name)
+		if err != nil {
+			log.Printf("Couldn't read the metadata mapping for %s: %v", name, err)
+			continue
+		}
+		log.Printf("Metadata mapping for %s: '%+v'\n", name, mapping)
+		devices = append(devices, normalizeEbsDeviceName(mapping))
+	}
+	return devices
+}
 
+// Merges what the metadata service thinks is mapped with what EC2 says
+// is attached right now. The metadata mapping only reflects what was
+// there at launch, so anything attached later only shows up in EC2.
+func mergeEbsBlockDevices(metadataDevices []string, attached map[string]string) []ebsBlockDevice {
+	devices := []ebsBlockDevice{}
+	seen := map[string]bool{}
+	for _, device := range metadataDevices {
+		if seen[device] {
+			continue
+		}
+		volumeID, ok := attached[device]
+		if !ok {
+			log.Printf("Metadata says %s is mapped, but no EBS volume is attached there, skipping", device)
+			continue
+		}
+		seen[device] = true
+		devices = append(devices, ebsBlockDevice{Device: device, VolumeID: volumeID})
+	}
+	extra := []string{}
+	for device := range attached {
+		if !seen[device] {
+			extra = append(extra, device)
+		}
+	}
+	sort.Strings(extra)
+	for _, device := range extra {
+		devices = append(devices, ebsBlockDevice{Device: device, VolumeID: attached[device]})
+	}
+	return devices
+}
+
+func getEbsBlockDevices(ec2Client *ec2.EC2, instanceID string) []ebsBlockDevice {
+	return mergeEbsBlockDevices(getMetadataBlockDevices(), getAttachedEbsVolumes(ec2Client, instanceID))
 }
 
 func fileExists(filename string) bool {
@@ -120,54 +208,22 @@ func fileExists(filename string) bool {
 
 // Takes into account
 // https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
-func mapEbsDeviceToLinuxDevice(ebsDevice string) string {
+func mapEbsDeviceToLinuxDevice(ebsDevice string) (string, error) {
+	var candidates []string
 	if ebsDevice == "/dev/sda1" {
-		if fileExists("/dev/nvme0n1p1") {
-			return "/dev/nvme0n1p1"
-		} else if fileExists("/dev/xvda1") {
-			return "/dev/xvda1"
-		} else if fileExists("/dev/sda1") {
-			return "/dev/sda1"
-		} else {
-			log.Panicf("AWS says the EBS device should be %s, but that doesn't exist?", ebsDevice)
-		}
+		candidates = []string{"/dev/nvme0n1p1", "/dev/xvda1", "/dev/sda1"}
 	} else if ebsDevice == "/dev/xvda1" {
-		if fileExists("/dev/nvme0n1p1") {
-			return "/dev/nvme0n1p1"
-		} else if fileExists("/dev/xvda1") {
-			return "/dev/xvda1"
-		} else {
-			log.Panicf("AWS says the EBS device should be %s, but that doesn't exist?", ebsDevice)
-		}
+		candidates = []string{"/dev/nvme0n1p1", "/dev/xvda1"}
 	} else {
-		if fileExists(ebsDevice) {
-			return ebsDevice
-		} else {
-			log.Panicf("It looks like %s doesn't exist on the system?", ebsDevice)
-		}
+		// On Xen /dev/sdf is presented to us as /dev/xvdf
+		candidates = []string{ebsDevice, strings.Replace(ebsDevice, "/dev/sd", "/dev/xvd", 1)}
 	}
-	return ebsDevice
-}
-
-func lookupMount(ebsDevice string) (string, string) {
-	device := mapEbsDeviceToLinuxDevice(ebsDevice)
-	out := safeRun([]string{"grep", "^" + device, "/proc/mounts"}, false)
-	numLines := strings.Count(out, "\n")
-	if numLines != 1 {
-		log.Printf("Ah! There was more than one mount with %v:\n%v", device, out)
-		os.Exit(1)
+	for _, candidate := range candidates {
+		if fileExists(candidate) {
+			return candidate, nil
+		}
 	}
-	split := strings.Split(out, " ")
-	partition := split[0]
-	mount := split[1]
-	return mount, partition
-}
-
-func mountNeedsResizing(mount string, threshold float64, verbose bool) bool {
-	df := safeRun([]string{"df", mount}, false)
-	percentUsed, _ := parseDfOutput(df)
-	log.Printf("%s has a usage of %.2f%%", mount, percentUsed*100)
-	return percentUsed > threshold
+	return "", fmt.Errorf("AWS says the EBS device should be %s, but that doesn't exist?", ebsDevice)
 }
 
 func isModificiationComplete(state *ec2.VolumeModification) bool {
@@ -191,18 +247,32 @@ func describeVolumeModification(volumeID string, ec2Client *ec2.EC2) (*ec2.Volum
 	return volumeMods.VolumesModifications[lastIndex], nil
 }
 
-func waitForResize(volumeID string, ec2Client *ec2.EC2) {
-	complete := false
-	for !complete {
-		log.Print("Sleeping 60 seconds, waiting for EBS volume resize to finish...")
-		time.Sleep(60 * time.Second)
+// How often to ask AWS how a volume modification is going
+var ebsModificationPollInterval = 60 * time.Second
+
+// Waits for a volume modification to finish, or for the kernel to see the
+// new size of disk (newSize in GiB), whichever happens first. The kernel
+// usually sees it well before AWS calls the modification complete, and
+// that's all the partition and filesystem need.
+func waitForResize(volumeID string, disk string, newSize int64, ec2Client *ec2.EC2) {
+	listener := listenForUevents()
+	defer listener.Close()
+	for {
+		if size, err := blockDeviceSize(disk); err == nil && size >= newSize<<30 {
+			log.Printf("The kernel already sees %s at %dGiB, not waiting for %s to finish modifying", disk, newSize, volumeID)
+			return
+		}
 		volumeModification, err := describeVolumeModification(volumeID, ec2Client)
 		if err != nil {
 			panic(err)
 		} else {
 			fmt.Println(volumeModification)
 		}
-		complete = isModificiationComplete(volumeModification)
+		if isModificiationComplete(volumeModification) {
+			return
+		}
+		log.Printf("Waiting up to %v for EBS volume %s to finish resizing...", ebsModificationPollInterval, volumeID)
+		listener.WaitForCapacityChange(disk, ebsModificationPollInterval)
 	}
 }
 
@@ -256,11 +326,107 @@ func getEbsVolumeIDAndSize(ec2Client *ec2.EC2, instanceID string, ebsDevice stri
 	return "", 0
 }
 
-func resizeEbsDevice(ebsDevice string, ec2Client *ec2.EC2, instanceID string, growPercent float64, dryRun bool) {
-	log.Printf("Resizing EBS device '%s' by %.2f%%!\n", ebsDevice, growPercent*100)
-	volumeID, existingSize := getEbsVolumeIDAndSize(ec2Client, instanceID, ebsDevice)
-	newSize := int64(math.Round(float64(existingSize) * (1.00 + growPercent)))
-	log.Printf("Growing EBS device '%s' by %.2f%% from %dGB to %dGB!\n", ebsDevice, growPercent*100, existingSize, newSize)
+// EBS sizes go in whole GiB, and a limit of 0 means there isn't one, so
+// anything that would round down to that can't be allowed through.
+func parseMaxSize(raw string) (int64, error) {
+	size, err := parseSize(raw)
+	if err != nil {
+		return 0, err
+	}
+	if size < 1<<30 {
+		return 0, fmt.Errorf("%s is less than the smallest volume size of 1GiB", raw)
+	}
+	return int64(size >> 30), nil
+}
+
+// The tighter of two size limits, where 0 means no limit
+func smallerSizeLimit(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Returns the volumes under a target that are already as big as
+// maxSize (in GiB) lets them get.
+func ebsVolumesAtMaxSize(target resizeTarget, ec2Client *ec2.EC2, instanceID string, maxSize int64) []string {
+	atMax := []string{}
+	for _, device := range target.Devices {
+		volumeID, size := getEbsVolumeIDAndSize(ec2Client, instanceID, device.Ebs.Device)
+		if size >= maxSize {
+			atMax = append(atMax, volumeID)
+		}
+	}
+	return atMax
+}
+
+// Works out what size to grow each volume to. With sameSize they are all
+// grown to the same size, as RAID members need to be. A maxSize (if not 0)
+// caps how big a volume can usefully get.
+func planEbsSizes(existingSizes []int64, maxSizes []int64, growth growth, sameSize bool) []int64 {
+	newSizes := make([]int64, len(existingSizes))
+	var largest int64
+	for i, existingSize := range existingSizes {
+		newSizes[i] = growth.NewSize(existingSize)
+		if existingSize > largest {
+			largest = existingSize
+		}
+	}
+	if sameSize {
+		common := growth.NewSize(largest)
+		for _, maxSize := range maxSizes {
+			if maxSize > 0 && maxSize < common {
+				common = maxSize
+			}
+		}
+		for i := range newSizes {
+			newSizes[i] = common
+		}
+	}
+	for i, maxSize := range maxSizes {
+		if maxSize > 0 && newSizes[i] > maxSize {
+			newSizes[i] = maxSize
+		}
+	}
+	return newSizes
+}
+
+// Grows all the EBS devices at once, which matters when there are several
+// under one filesystem as each one can take a good while. Returns the size
+// each one is now.
+func resizeEbsDevices(devices []backingDevice, ec2Client *ec2.EC2, instanceID string, growth growth, sameSize bool, dryRun bool) []int64 {
+	volumeIDs := make([]string, len(devices))
+	existingSizes := make([]int64, len(devices))
+	maxSizes := make([]int64, len(devices))
+	for i, device := range devices {
+		log.Printf("Resizing EBS device '%s', going to %s!\n", device.Ebs.Device, growth)
+		volumeIDs[i], existingSizes[i] = getEbsVolumeIDAndSize(ec2Client, instanceID, device.Ebs.Device)
+		maxSizes[i] = device.MaxSize
+	}
+	newSizes := planEbsSizes(existingSizes, maxSizes, growth, sameSize)
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		if newSizes[i] <= existingSizes[i] {
+			log.Printf("Not growing EBS device '%s' (%s), it is already %dGB and can't usefully get bigger than %dGB", device.Ebs.Device, volumeIDs[i], existingSizes[i], newSizes[i])
+			newSizes[i] = existingSizes[i]
+			continue
+		}
+		log.Printf("Growing EBS device '%s' (%s) from %dGB to %dGB!\n", device.Ebs.Device, volumeIDs[i], existingSizes[i], newSizes[i])
+		disk, err := diskForBlockDevice(filepath.Base(device.Partition))
+		if err != nil {
+			log.Panicf("Couldn't find the disk under %s: %v", device.Partition, err)
+		}
+		wg.Add(1)
+		go func(volumeID string, newSize int64, disk string) {
+			defer wg.Done()
+			modifyEbsVolume(volumeID, newSize, disk, ec2Client, dryRun)
+		}(volumeIDs[i], newSizes[i], disk)
+	}
+	wg.Wait()
+	return newSizes
+}
+
+func modifyEbsVolume(volumeID string, newSize int64, disk string, ec2Client *ec2.EC2, dryRun bool) {
 	request := &ec2.ModifyVolumeInput{
 		VolumeId: &volumeID,
 		Size:     aws.Int64(newSize),
@@ -278,26 +444,28 @@ func resizeEbsDevice(ebsDevice string, ec2Client *ec2.EC2, instanceID string, gr
 	if dryRun {
 		return
 	} else {
-		time.Sleep(10 * time.Second)
 		volumeModification := output.VolumeModification
 		if isModificiationComplete(volumeModification) {
 			return
 		}
-		waitForResize(volumeID, ec2Client)
+		waitForResize(volumeID, disk, newSize, ec2Client)
 		return
 	}
 }
 
 func parsePartitionIntoDeviceAndNumber(partition string) (string, string) {
-	device := partition[0 : len(partition)-1]
-	partitionNumber := partition[len(partition)-1:]
+	numberStart := len(partition)
+	for numberStart > 0 && partition[numberStart-1] >= '0' && partition[numberStart-1] <= '9' {
+		numberStart--
+	}
+	device := partition[0:numberStart]
+	partitionNumber := partition[numberStart:]
 	if _, err := strconv.Atoi(partitionNumber); err != nil {
 		log.Panicf("%v doesn't looks like a number? Should be the partition number of %s\n", partitionNumber, partition)
 	}
 	lastCharOfDevice := device[len(device)-1:]
 	if lastCharOfDevice == "p" {
-		device = partition[0 : len(partition)-2]
-		lastCharOfDevice = device[len(device)-1:]
+		device = device[0 : len(device)-1]
 	} else {
 		if _, err := strconv.Atoi(lastCharOfDevice); err == nil {
 			log.Panicf("%v ends in a number? Should just be the device part of %s\n", device, partition)
@@ -306,25 +474,6 @@ func parsePartitionIntoDeviceAndNumber(partition string) (string, string) {
 	return device, partitionNumber
 }
 
-func growPartition(partition string, dryRun bool) {
-	device, partitionNumber := parsePartitionIntoDeviceAndNumber(partition)
-	log.Printf("Going to grow parition %s!\n", partition)
-	if dryRun {
-		safeRun([]string{"growpart", "--dry-run", device, partitionNumber}, false)
-	} else {
-		safeRun([]string{"growpart", device, partitionNumber}, false)
-	}
-}
-
-func resizeFilesystem(partition string, dryRun bool) {
-	if dryRun {
-		log.Printf("Would resize filesystem on partition %s\n", partition)
-	} else {
-		log.Printf("Going to resize filesystem on partition %s!\n", partition)
-	}
-	safeRun([]string{"resize2fs", partition}, dryRun)
-}
-
 func main() {
 	args := parseArgs()
 	verbose := args["--verbose"].(bool)
@@ -333,33 +482,132 @@ func main() {
 	raw_threshold := args["--threshold"].(string)
 	threshold, _ := strconv.ParseFloat(raw_threshold, 64)
 	threshold = threshold / float64(100)
+	inodeThreshold, _ := strconv.ParseFloat(args["--inode-threshold"].(string), 64)
+	thresholds := usageThresholds{
+		Used:           threshold,
+		Inodes:         inodeThreshold / float64(100),
+		Trigger:        args["--trigger"].(string),
+		ReservedAsUsed: args["--reserved-as-used"].(bool),
+	}
+	if thresholds.Trigger != "any" && thresholds.Trigger != "all" {
+		log.Fatalf("--trigger has to be any or all, not %s", thresholds.Trigger)
+	}
+	var err error
+	if minFree, ok := args["--min-free"].(string); ok {
+		if thresholds.MinFree, err = parseSize(minFree); err != nil {
+			log.Fatalf("Bad --min-free: %v", err)
+		}
+	}
+	if targetFree, ok := args["--target-free"].(string); ok {
+		if thresholds.TargetFree, err = parseSize(targetFree); err != nil {
+			log.Fatalf("Bad --target-free: %v", err)
+		}
+	}
+	maxSize, err := parseMaxSize(args["--max-size"].(string))
+	if err != nil {
+		log.Fatalf("Bad --max-size: %v", err)
+	}
 
 	raw_grow_percent := args["--grow-percent"].(string)
 	grow_percent, _ := strconv.ParseFloat(raw_grow_percent, 64)
 	grow_percent = grow_percent / float64(100)
-
-	region := getRegion()
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-	)
+	sizes := map[string]int64{}
+	for _, flag := range []string{"--min-increment", "--grow-step", "--granularity"} {
+		if sizes[flag], err = parseGrowthSize(args[flag].(string)); err != nil {
+			log.Fatalf("Bad %s: %v", flag, err)
+		}
+	}
+	targetUsage, _ := strconv.ParseFloat(args["--target-usage"].(string), 64)
+	strategy, err := newGrowthStrategy(args["--strategy"].(string), grow_percent, sizes["--min-increment"], sizes["--grow-step"], targetUsage/float64(100))
 	if err != nil {
-		fmt.Printf("error creating AWS EC2 client: %v", err)
-		os.Exit(1)
+		log.Fatal(err)
 	}
-	ec2Client := ec2.New(sess)
-	instanceID := getInstanceID(ec2Client)
-
-	EbsBlockDevices := getEbsBlockDevices()
-	for _, ebsDevice := range EbsBlockDevices {
-		mount, partition := lookupMount(ebsDevice)
-		log.Printf("Inspecting ebs device %s mounted on %s (real device name %s\n", ebsDevice, mount, partition)
-		if mountNeedsResizing(mount, threshold, verbose) {
-			log.Printf("%s is used more than our threshold (%.2f%%), resizing!", mount, threshold)
-			resizeEbsDevice(ebsDevice, ec2Client, instanceID, grow_percent, dryRun)
-			growPartition(partition, dryRun)
-			resizeFilesystem(partition, dryRun)
+
+	lvmExtend := args["--lvm-extend"].(string)
+	cryptKeyFile, _ := args["--crypt-keyfile"].(string)
+	convertToGPT := args["--convert-mbr-to-gpt"].(bool)
+	spillover := args["--spillover"].(bool)
+
+	san := args["--san"].(bool)
+	growCommand, _ := args["--grow-command"].(string)
+
+	options := resizeOptions{
+		Growth:       growth{Strategy: strategy, Granularity: sizes["--granularity"]},
+		MaxSize:      maxSize,
+		LvmExtend:    lvmExtend,
+		CryptKeyFile: cryptKeyFile,
+		ConvertToGPT: convertToGPT,
+		Spillover:    spillover,
+		San:          san,
+		GrowCommand:  growCommand,
+		DryRun:       dryRun,
+	}
+	var targets []resizeTarget
+	if san {
+		targets = findSanTargets()
+	} else {
+		region := getRegion()
+		sess, err := session.NewSession(&aws.Config{
+			Region: aws.String(region)},
+		)
+		if err != nil {
+			fmt.Printf("error creating AWS EC2 client: %v", err)
+			os.Exit(1)
+		}
+		options.EC2Client = ec2.New(sess)
+		options.InstanceID = getInstanceID(options.EC2Client)
+		targets = findResizeTargets(getEbsBlockDevices(options.EC2Client, options.InstanceID))
+	}
+	paths := args["--path"].([]string)
+	if len(paths) > 0 {
+		targets, err = selectTargetsByPath(paths, targets)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Plan everything up front, so nothing is touched if any of it can't be done
+	plans := []resizePlan{}
+	planned := map[string]bool{}
+	pinned := []string{}
+	for _, target := range targets {
+		mount := target.Mount
+		log.Printf("Inspecting %s filesystem mounted on %s (real devices %v)\n", target.FSType, mount, target.Partitions())
+		if !canResizeFilesystem(target.FSType) {
+			log.Printf("Skipping %s, we don't know how to grow %s filesystems", mount, target.FSType)
+			continue
+		}
+		if needsResizing, minGrowPercent := filesystemNeedsResizing(target, thresholds, verbose); needsResizing {
+			if !san && options.MaxSize > 0 {
+				atMax := ebsVolumesAtMaxSize(target, options.EC2Client, options.InstanceID, options.MaxSize)
+				if len(atMax) == len(target.Devices) {
+					log.Printf("ALERT: %s is over our thresholds, but %v already at the --max-size of %dGiB, so it can't grow any more. Someone needs to look at it!", mount, atMax, options.MaxSize)
+					pinned = append(pinned, mount)
+					continue
+				}
+			}
+			log.Printf("%s is over our thresholds, resizing!", mount)
+			targetOptions := options
+			targetOptions.Growth.MinPercent = minGrowPercent
+			if _, ok := strategy.(targetUsageGrowth); ok {
+				targetOptions.Growth.UsedFraction = filesystemUsedFraction(target, thresholds.ReservedAsUsed)
+			}
+			plan, err := buildResizePlan(target, targetOptions, planned)
+			if err != nil {
+				log.Fatalf("Can't resize %s: %v", mount, err)
+			}
+			plans = append(plans, plan)
 		} else {
 			log.Printf("%s doesn't need to be resized", mount)
 		}
 	}
+	for _, plan := range plans {
+		if dryRun || verbose {
+			log.Printf("%s", plan)
+		}
+		plan.Run()
+	}
+	if len(pinned) > 0 {
+		log.Printf("ALERT: %v stuck at --max-size and still over our thresholds", pinned)
+		os.Exit(2)
+	}
 }
@@ -15,3 +15,68 @@ func TestParsePartitionIntoDeviceAndNumber(t *testing.T) {
 	assert.Equal(t, actualD, "/dev/nvme0n1")
 	assert.Equal(t, actualN, "1")
 }
+
+func TestMergeEbsBlockDevices(t *testing.T) {
+	attached := map[string]string{
+		"/dev/xvda": "vol-root",
+		"/dev/sdg":  "vol-late",
+		"/dev/sdf":  "vol-data",
+	}
+	actual := mergeEbsBlockDevices([]string{"/dev/xvda", "/dev/xvda", "/dev/sdf", "/dev/sdz"}, attached)
+	assert.DeepEqual(t, actual, []ebsBlockDevice{
+		{Device: "/dev/xvda", VolumeID: "vol-root"},
+		{Device: "/dev/sdf", VolumeID: "vol-data"},
+		{Device: "/dev/sdg", VolumeID: "vol-late"},
+	})
+
+	assert.Equal(t, isEbsMappingName("ebs1"), true)
+	assert.Equal(t, isEbsMappingName("ephemeral0"), false)
+	assert.Equal(t, normalizeEbsDeviceName("sdb"), "/dev/sdb")
+}
+
+func TestParsePartitionIntoDeviceAndNumberMultipleDigits(t *testing.T) {
+	actualD, actualN := parsePartitionIntoDeviceAndNumber("/dev/xvda15")
+	assert.Equal(t, actualD, "/dev/xvda")
+	assert.Equal(t, actualN, "15")
+
+	actualD, actualN = parsePartitionIntoDeviceAndNumber("/dev/nvme0n1p128")
+	assert.Equal(t, actualD, "/dev/nvme0n1")
+	assert.Equal(t, actualN, "128")
+}
+
+func TestPlanEbsSizes(t *testing.T) {
+	tenPercent := growth{Strategy: percentGrowth{Percent: 0.1}}
+	assert.DeepEqual(t, planEbsSizes([]int64{100, 200}, []int64{0, 0}, tenPercent, false), []int64{110, 220})
+	assert.DeepEqual(t, planEbsSizes([]int64{100, 200}, []int64{0, 0}, tenPercent, true), []int64{220, 220})
+	// An MBR disk can't usefully go past 2TiB
+	assert.DeepEqual(t, planEbsSizes([]int64{1900, 100}, []int64{2048, 0}, tenPercent, false), []int64{2048, 110})
+	assert.DeepEqual(t, planEbsSizes([]int64{2048}, []int64{2048}, tenPercent, false), []int64{2048})
+	assert.DeepEqual(t, planEbsSizes([]int64{1900, 1900}, []int64{0, 2048}, tenPercent, true), []int64{2048, 2048})
+}
+
+func TestParseMaxSize(t *testing.T) {
+	size, err := parseMaxSize("1TiB")
+	assert.NilError(t, err)
+	assert.Equal(t, size, int64(1024))
+	size, err = parseMaxSize("1.5GiB")
+	assert.NilError(t, err)
+	assert.Equal(t, size, int64(1))
+
+	// These would otherwise come out as 0, which is no limit at all
+	_, err = parseMaxSize("512MiB")
+	assert.Error(t, err, "512MiB is less than the smallest volume size of 1GiB")
+	_, err = parseMaxSize("0")
+	assert.Error(t, err, "0 is less than the smallest volume size of 1GiB")
+	_, err = parseMaxSize("lots")
+	assert.ErrorContains(t, err, "isn't a size")
+}
+
+func TestSmallerSizeLimit(t *testing.T) {
+	assert.Equal(t, smallerSizeLimit(0, 1024), int64(1024))
+	assert.Equal(t, smallerSizeLimit(2048, 1024), int64(1024))
+	assert.Equal(t, smallerSizeLimit(2048, 0), int64(2048))
+	assert.Equal(t, smallerSizeLimit(0, 0), int64(0))
+	// --max-size clamps the grown size, and a volume at the cap stays there
+	tenPercent := growth{Strategy: percentGrowth{Percent: 0.1}}
+	assert.DeepEqual(t, planEbsSizes([]int64{1000, 1024}, []int64{1024, 1024}, tenPercent, false), []int64{1024, 1024})
+}
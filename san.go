@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Multipath maps have dm uuids like mpath-<wwid>, and kpartx gives the
+// partitions on them uuids like part1-mpath-<wwid>.
+func isMultipathDevice(name string) bool {
+	uuid, err := readSysfsString(filepath.Join("class/block", name, "dm/uuid"))
+	return err == nil && strings.HasPrefix(uuid, "mpath-")
+}
+
+func multipathPartitionNumber(name string) (int, bool) {
+	uuid, err := readSysfsString(filepath.Join("class/block", name, "dm/uuid"))
+	if err != nil {
+		return 0, false
+	}
+	var number int
+	var rest string
+	if _, err := fmt.Sscanf(uuid, "part%d-%s", &number, &rest); err != nil {
+		return 0, false
+	}
+	return number, strings.HasPrefix(rest, "mpath-")
+}
+
+func isMultipathPartitionDevice(name string) bool {
+	_, ok := multipathPartitionNumber(name)
+	return ok
+}
+
+// SAN disks are the SCSI disks that come from an iSCSI session or a
+// fibre channel port, as opposed to ones plugged into the machine.
+func isSanDisk(disk string) bool {
+	path, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class/block", disk))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(path, "/session") || strings.Contains(path, "/rport-")
+}
+
+func iscsiSessions() []string {
+	sessions, _ := filepath.Glob(filepath.Join(sysfsRoot, "class/iscsi_session/session*"))
+	return sessions
+}
+
+func rescanIscsiSessions(dryRun bool) {
+	log.Printf("Rescanning iSCSI sessions\n")
+	safeRun([]string{"iscsiadm", "-m", "session", "--rescan"}, dryRun)
+}
+
+// Every path to a LUN is its own SCSI disk, and each one needs rescanning
+// before multipath will believe the LUN has grown.
+func rescanScsiPaths(disks []string, dryRun bool) {
+	for _, disk := range disks {
+		if dryRun {
+			log.Printf("Would rescan %s", disk)
+			continue
+		}
+		before, _ := blockDeviceSize(disk)
+		if err := rescanBlockDevice(disk); err != nil {
+			log.Panicf("Couldn't rescan %s: %v", disk, err)
+		}
+		after, _ := blockDeviceSize(disk)
+		log.Printf("Rescanned %s, it went from %d to %d bytes", disk, before, after)
+	}
+}
+
+// Whatever grows the LUNs on the array, given the mount point and the disks under it
+func runGrowCommand(command string, mount string, disks []string, dryRun bool) {
+	log.Printf("Running '%s' to grow the LUNs under %s\n", command, mount)
+	safeRun(append(append(strings.Fields(command), mount), disks...), dryRun)
+}
+
+func resizeMultipathMap(name string, dryRun bool) {
+	log.Printf("Resizing multipath map %s\n", name)
+	safeRun([]string{"multipathd", "resize", "map", name}, dryRun)
+}
+
+// Partitions on a multipath map are device mapper devices made by kpartx,
+// so it's kpartx that has to be told about the new partition table.
+func growMultipathPartition(name string, dryRun bool) {
+	number, _ := multipathPartitionNumber(name)
+	slaves := slaveDevices(name)
+	if len(slaves) != 1 {
+		log.Panicf("Expected %s to be on exactly one multipath map, but it is on %v", devicePath(name), slaves)
+	}
+	mapPath := devicePath(slaves[0])
+	flags := os.O_RDWR
+	if dryRun {
+		flags = os.O_RDONLY
+	}
+	disk, err := os.OpenFile(mapPath, flags, 0)
+	if err != nil {
+		log.Panicf("Couldn't open %s to grow partition %d: %v", mapPath, number, err)
+	}
+	defer disk.Close()
+	before, after, err := growPartitionTable(disk, number, dryRun)
+	if err != nil {
+		log.Panicf("Couldn't grow partition %d on %s: %v", number, mapPath, err)
+	}
+	if after.Sectors <= before.Sectors {
+		log.Printf("%s already fills the disk, nothing to grow", devicePath(name))
+		return
+	}
+	if dryRun {
+		log.Printf("Would grow %s from %d to %d sectors", devicePath(name), before.Sectors, after.Sectors)
+		return
+	}
+	log.Printf("Grew %s from %d to %d sectors", devicePath(name), before.Sectors, after.Sectors)
+	if err := disk.Sync(); err != nil {
+		log.Panicf("Couldn't sync the partition table on %s: %v", mapPath, err)
+	}
+	safeRun([]string{"kpartx", "-u", mapPath}, dryRun)
+}
+
+// On SAN storage the LUNs get grown on the array, by someone else or by
+// the grow command, then every layer of the host has to be told about it.
+func sanSteps(target resizeTarget, devices []backingDevice, options resizeOptions, planned map[string]bool) ([]planStep, error) {
+	if len(devices) == 0 {
+		return nil, nil
+	}
+	disks := []string{}
+	diskPaths := []string{}
+	seen := map[string]bool{}
+	for _, device := range devices {
+		disk, err := diskForBlockDevice(filepath.Base(device.Partition))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the disk under %s: %v", device.Partition, err)
+		}
+		if !seen[disk] {
+			seen[disk] = true
+			disks = append(disks, disk)
+			diskPaths = append(diskPaths, devicePath(disk))
+		}
+	}
+	steps := []planStep{}
+	if options.GrowCommand != "" {
+		steps = append(steps, planStep{
+			Layer:       "san",
+			Device:      strings.Join(diskPaths, ", "),
+			Description: "run " + options.GrowCommand,
+			Run:         func() { runGrowCommand(options.GrowCommand, target.Mount, diskPaths, options.DryRun) },
+		})
+	}
+	if len(iscsiSessions()) > 0 && !planned["iscsi"] {
+		planned["iscsi"] = true
+		steps = append(steps, planStep{
+			Layer:       "san",
+			Device:      "iscsi",
+			Description: "iscsiadm -m session --rescan",
+			Run:         func() { rescanIscsiSessions(options.DryRun) },
+		})
+	}
+	return append(steps, planStep{
+		Layer:       "san",
+		Device:      strings.Join(diskPaths, ", "),
+		Description: "rescan SCSI paths",
+		Run:         func() { rescanScsiPaths(disks, options.DryRun) },
+	}), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// Lays out a SCSI disk that came in over an iSCSI session
+func addFakeSanDisk(t *testing.T, disk string, lun int) {
+	diskPath := filepath.Join("devices/platform/host2/session1/target2:0:0", "2:0:0:"+string(rune('0'+lun)), "block", disk)
+	writeSysfsFile(t, filepath.Join(diskPath, "size"), "2097152")
+	writeSysfsFile(t, filepath.Join(diskPath, "device/rescan"), "")
+	for _, name := range []string{"block", "class/block"} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(sysfsRoot, name), 0755))
+		assert.NilError(t, os.Symlink(filepath.Join(sysfsRoot, diskPath), filepath.Join(sysfsRoot, name, disk)))
+	}
+}
+
+func TestIsSanDisk(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeSanDisk(t, "sdb", 1)
+	addFakeDisk(t, "sda", "sda1")
+
+	assert.Equal(t, isSanDisk("sdb"), true)
+	assert.Equal(t, isSanDisk("sda"), false)
+	assert.Equal(t, isSanDisk("sdz"), false)
+}
+
+func TestMultipathPartitionNumber(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeSanDisk(t, "sdb", 1)
+	addFakeDmDevice(t, "dm-0", "mpatha", "mpath-36001405abcdef", "sdb")
+	addFakeDmDevice(t, "dm-1", "mpatha1", "part1-mpath-36001405abcdef", "dm-0")
+	addFakeDmDevice(t, "dm-2", "vg-data", "LVM-abc", "dm-1")
+
+	number, ok := multipathPartitionNumber("dm-1")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, number, 1)
+	_, ok = multipathPartitionNumber("dm-0")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, isMultipathDevice("dm-0"), true)
+	assert.Equal(t, isMultipathDevice("dm-1"), false)
+	assert.Equal(t, storageLayerKind("dm-0"), layerMultipath)
+	assert.Equal(t, storageLayerKind("dm-1"), layerMpathPart)
+	assert.Equal(t, storageLayerKind("dm-2"), layerLvm)
+}
+
+func TestBuildResizePlanSan(t *testing.T) {
+	defer useFakeSysfs(t)()
+	// One LUN, two paths to it
+	addFakeSanDisk(t, "sdb", 1)
+	addFakeSanDisk(t, "sdc", 2)
+	assert.NilError(t, os.MkdirAll(filepath.Join(sysfsRoot, "class/iscsi_session/session1"), 0755))
+	addFakeDmDevice(t, "dm-0", "mpatha", "mpath-36001405abcdef", "sdb", "sdc")
+	addFakeDmDevice(t, "dm-1", "mpatha1", "part1-mpath-36001405abcdef", "dm-0")
+	addFakeDmDevice(t, "dm-2", "vg-data", "LVM-abc", "dm-1")
+
+	target := resizeTarget{
+		Mount:        "/data",
+		FSType:       "xfs",
+		Device:       "/dev/mapper/vg-data",
+		StackDevices: []string{"dm-2"},
+		Devices: []backingDevice{
+			{Partition: "/dev/sdb"},
+			{Partition: "/dev/sdc"},
+		},
+	}
+	options := resizeOptions{San: true, GrowCommand: "/usr/local/bin/grow-lun", LvmExtend: "+100%FREE"}
+	plan, err := buildResizePlan(target, options, map[string]bool{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, planStepSummaries(plan), []string{
+		"[san] /dev/sdb, /dev/sdc: run /usr/local/bin/grow-lun",
+		"[san] iscsi: iscsiadm -m session --rescan",
+		"[san] /dev/sdb, /dev/sdc: rescan SCSI paths",
+		"[multipath] /dev/mapper/mpatha: multipathd resize map",
+		"[partition] /dev/mapper/mpatha1: grow to the end of the disk",
+		"[lvm] /dev/mapper/mpatha1: pvresize",
+		"[lvm] /dev/mapper/vg-data: lvextend +100%FREE",
+		"[filesystem] /data: grow xfs",
+	})
+}
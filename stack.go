@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type layerKind string
+
+const (
+	layerDisk      layerKind = "disk"
+	layerPartition layerKind = "partition"
+	layerLvm       layerKind = "lvm"
+	layerCrypt     layerKind = "crypt"
+	layerMd        layerKind = "md"
+	layerMultipath layerKind = "multipath"
+	layerMpathPart layerKind = "multipath partition"
+	layerLoop      layerKind = "loop"
+	layerDm        layerKind = "dm"
+)
+
+// One block device in the storage stack underneath a filesystem, along
+// with the devices it is built on.
+type storageLayer struct {
+	Name   string
+	Kind   layerKind
+	Slaves []*storageLayer
+}
+
+func (l *storageLayer) Path() string {
+	return devicePath(l.Name)
+}
+
+func (l *storageLayer) IsSupported() bool {
+	switch l.Kind {
+	case layerLoop, layerDm:
+		return false
+	}
+	return true
+}
+
+func storageLayerKind(name string) layerKind {
+	switch {
+	case isPartition(name):
+		return layerPartition
+	case isMdDevice(name):
+		return layerMd
+	case isMultipathDevice(name):
+		return layerMultipath
+	case isMultipathPartitionDevice(name):
+		return layerMpathPart
+	case isLvmDevice(name):
+		return layerLvm
+	case isCryptDevice(name):
+		return layerCrypt
+	case strings.HasPrefix(name, "loop"):
+		return layerLoop
+	case sysfsExists(filepath.Join("class/block", name, "dm")):
+		return layerDm
+	}
+	return layerDisk
+}
+
+// Walks from a block device down through its slaves to the disks at the
+// bottom. Partitions have no slaves as far as sysfs is concerned, so
+// their disk is filled in by hand.
+func walkStorageStack(name string) *storageLayer {
+	layer := &storageLayer{Name: name, Kind: storageLayerKind(name)}
+	if layer.Kind == layerPartition {
+		if disk, err := diskForBlockDevice(name); err == nil {
+			layer.Slaves = append(layer.Slaves, &storageLayer{Name: disk, Kind: layerDisk})
+		}
+		return layer
+	}
+	for _, slave := range slaveDevices(name) {
+		layer.Slaves = append(layer.Slaves, walkStorageStack(slave))
+	}
+	return layer
+}
+
+func (l *storageLayer) describe(indent string, lines []string) []string {
+	lines = append(lines, fmt.Sprintf("%s%s (%s)", indent, l.Path(), l.Kind))
+	for _, slave := range l.Slaves {
+		lines = slave.describe(indent+"  ", lines)
+	}
+	return lines
+}
+
+// Calls visit on every layer, bottom first
+func (l *storageLayer) walkBottomUp(visit func(*storageLayer)) {
+	for _, slave := range l.Slaves {
+		slave.walkBottomUp(visit)
+	}
+	visit(l)
+}
+
+type resizeOptions struct {
+	EC2Client    *ec2.EC2
+	InstanceID   string
+	Growth       growth
+	MaxSize      int64
+	LvmExtend    string
+	CryptKeyFile string
+	ConvertToGPT bool
+	Spillover    bool
+	San          bool
+	GrowCommand  string
+	DryRun       bool
+}
+
+type planStep struct {
+	Layer       string
+	Device      string
+	Description string
+	Run         func()
+}
+
+// Everything that has to happen, in order, to grow one filesystem
+type resizePlan struct {
+	Target resizeTarget
+	Stacks []*storageLayer
+	Steps  []planStep
+}
+
+func (p resizePlan) String() string {
+	lines := []string{fmt.Sprintf("Storage stack for %s (%s):", p.Target.Mount, p.Target.FSType)}
+	for _, stack := range p.Stacks {
+		lines = stack.describe("  ", lines)
+	}
+	lines = append(lines, fmt.Sprintf("Resize plan for %s:", p.Target.Mount))
+	for i, step := range p.Steps {
+		lines = append(lines, fmt.Sprintf("  %d. [%s] %s: %s", i+1, step.Layer, step.Device, step.Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p resizePlan) Run() {
+	for i, step := range p.Steps {
+		log.Printf("Step %d/%d [%s] %s: %s", i+1, len(p.Steps), step.Layer, step.Device, step.Description)
+		step.Run()
+	}
+}
+
+// Works out every step needed to grow a filesystem, from the EBS volumes
+// at the bottom to the filesystem at the top. Anything we can't grow is
+// an error here, before a single thing has been modified. Layers already
+// in the planned set (shared with another filesystem) are left out.
+func buildResizePlan(target resizeTarget, options resizeOptions, planned map[string]bool) (resizePlan, error) {
+	plan := resizePlan{Target: target}
+	hasMd := false
+	for _, name := range target.StackDevices {
+		stack := walkStorageStack(name)
+		plan.Stacks = append(plan.Stacks, stack)
+		var err error
+		stack.walkBottomUp(func(layer *storageLayer) {
+			if err != nil {
+				return
+			}
+			if !layer.IsSupported() {
+				err = fmt.Errorf("%s is a %s device, which we don't know how to grow", layer.Path(), layer.Kind)
+			} else if layer.Kind == layerCrypt {
+				err = checkCryptResizable(layer.Name, options.CryptKeyFile)
+			}
+			hasMd = hasMd || layer.Kind == layerMd
+		})
+		if err != nil {
+			return plan, err
+		}
+	}
+
+	devices := []backingDevice{}
+	for _, device := range target.Devices {
+		if planned[device.Partition] {
+			log.Printf("%s is already being grown for another filesystem", device.Partition)
+			continue
+		}
+		planned[device.Partition] = true
+		devices = append(devices, device)
+	}
+	convert := map[string]bool{}
+	for i, device := range devices {
+		if !isPartition(filepath.Base(device.Partition)) {
+			continue
+		}
+		maxSize, convertToGPT, err := mbrSizeLimit(device.Partition, options.ConvertToGPT)
+		if err != nil {
+			return plan, err
+		}
+		devices[i].MaxSize = maxSize
+		convert[device.Partition] = convertToGPT
+	}
+	for i := range devices {
+		devices[i].MaxSize = smallerSizeLimit(devices[i].MaxSize, options.MaxSize)
+	}
+	var diskSteps []planStep
+	var err error
+	if options.San {
+		diskSteps, err = sanSteps(target, devices, options, planned)
+	} else if len(devices) > 0 {
+		diskSteps, err = ebsSteps(devices, options, hasMd)
+	}
+	if err != nil {
+		return plan, err
+	}
+	plan.Steps = append(plan.Steps, diskSteps...)
+	for _, device := range devices {
+		partition := device.Partition
+		if target.FSType == "zfs" && isZfsWholeDiskPartition(partition) {
+			log.Printf("%s is a ZFS whole disk vdev, zpool will grow the partition", partition)
+		} else if isPartition(filepath.Base(partition)) {
+			if convert[partition] {
+				plan.Steps = append(plan.Steps, planStep{
+					Layer:       "partition",
+					Device:      partition,
+					Description: "convert MBR to GPT",
+					Run:         func() { convertPartitionTable(partition, options.DryRun) },
+				})
+			}
+			if err := checkPartitionGrowable(partition); err != nil {
+				if _, ok := err.(*partitionNotLastError); !ok {
+					return plan, fmt.Errorf("can't grow %s: %v", partition, err)
+				}
+				steps, spilloverErr := spilloverSteps(partition, target, plan.Stacks, options)
+				if spilloverErr != nil {
+					return plan, fmt.Errorf("can't grow %s: %v (%v)", partition, err, spilloverErr)
+				}
+				plan.Steps = append(plan.Steps, steps...)
+				continue
+			}
+			description := "grow to the end of the disk"
+			if isLogicalPartition(partition) {
+				description = "grow the extended partition, then this one, to the end of the disk"
+			}
+			plan.Steps = append(plan.Steps, planStep{
+				Layer:       "partition",
+				Device:      partition,
+				Description: description,
+				Run:         func() { growPartition(partition, options.DryRun) },
+			})
+		}
+	}
+
+	for _, stack := range plan.Stacks {
+		var err error
+		stack.walkBottomUp(func(layer *storageLayer) {
+			if err != nil || planned[layer.Name] {
+				return
+			}
+			planned[layer.Name] = true
+			var steps []planStep
+			steps, err = layerSteps(layer, options, planned)
+			plan.Steps = append(plan.Steps, steps...)
+		})
+		if err != nil {
+			return plan, err
+		}
+	}
+
+	plan.Steps = append(plan.Steps, planStep{
+		Layer:       "filesystem",
+		Device:      target.Mount,
+		Description: "grow " + target.FSType,
+		Run:         func() { resizeFilesystem(target, options.DryRun) },
+	})
+	return plan, nil
+}
+
+// Returns the layer directly on top of name, nil if name is at the top
+func parentLayer(stacks []*storageLayer, name string) *storageLayer {
+	var parent *storageLayer
+	for _, stack := range stacks {
+		stack.walkBottomUp(func(layer *storageLayer) {
+			for _, slave := range layer.Slaves {
+				if slave.Name == name {
+					parent = layer
+				}
+			}
+		})
+	}
+	return parent
+}
+
+// A partition with another one after it can't grow, but the new space on
+// the disk can still go into a partition of its own, as long as what sits
+// on the partition can take on another device.
+func spilloverSteps(partition string, target resizeTarget, stacks []*storageLayer, options resizeOptions) ([]planStep, error) {
+	if !options.Spillover {
+		return nil, fmt.Errorf("--spillover could put the new space in a partition of its own")
+	}
+	newPartition := new(string)
+	parent := parentLayer(stacks, filepath.Base(partition))
+	var add planStep
+	switch {
+	case parent != nil && parent.Kind == layerLvm:
+		vg, err := lvmVolumeGroup(parent.Name)
+		if err != nil {
+			return nil, err
+		}
+		add = planStep{
+			Layer:       "lvm",
+			Device:      vg,
+			Description: "vgextend with the new partition",
+			Run:         func() { addPhysicalVolume(vg, *newPartition, options.DryRun) },
+		}
+	case parent == nil && target.FSType == "btrfs":
+		add = planStep{
+			Layer:       "filesystem",
+			Device:      target.Mount,
+			Description: "btrfs device add the new partition",
+			Run:         func() { addBtrfsDevice(target.Mount, *newPartition, options.DryRun) },
+		}
+	default:
+		return nil, fmt.Errorf("spilling over only works for LVM physical volumes and btrfs")
+	}
+	if err := checkSpilloverPartition(partition); err != nil {
+		return nil, err
+	}
+	forLvm := add.Layer == "lvm"
+	create := planStep{
+		Layer:       "partition",
+		Device:      partition,
+		Description: "create a new partition after the last one",
+		Run:         func() { *newPartition = addSpilloverPartition(partition, forLvm, options.DryRun) },
+	}
+	return []planStep{create, add}, nil
+}
+
+// Grows the EBS volumes under a filesystem, then waits for the kernel to
+// notice they have.
+func ebsSteps(devices []backingDevice, options resizeOptions, hasMd bool) ([]planStep, error) {
+	volumeIDs := []string{}
+	for _, device := range devices {
+		volumeIDs = append(volumeIDs, device.Ebs.VolumeID)
+	}
+	description := options.Growth.String()
+	if hasMd {
+		description += ", all to the same size"
+	}
+	disks := []string{}
+	diskPaths := []string{}
+	for _, device := range devices {
+		disk, err := diskForBlockDevice(filepath.Base(device.Partition))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the disk under %s: %v", device.Partition, err)
+		}
+		disks = append(disks, disk)
+		diskPaths = append(diskPaths, devicePath(disk))
+	}
+	var newSizes []int64
+	return []planStep{{
+		Layer:       "ebs",
+		Device:      strings.Join(volumeIDs, ", "),
+		Description: description,
+		Run: func() {
+			newSizes = resizeEbsDevices(devices, options.EC2Client, options.InstanceID, options.Growth, hasMd, options.DryRun)
+		},
+	}, {
+		Layer:       "ebs",
+		Device:      strings.Join(diskPaths, ", "),
+		Description: "rescan until the kernel sees the new size",
+		Run:         func() { waitForBlockDeviceSizes(disks, newSizes, options.DryRun) },
+	}}, nil
+}
+
+func layerSteps(layer *storageLayer, options resizeOptions, planned map[string]bool) ([]planStep, error) {
+	path := layer.Path()
+	switch layer.Kind {
+	case layerMd:
+		return []planStep{{
+			Layer:       "md",
+			Device:      path,
+			Description: "mdadm --grow --size=max",
+			Run:         func() { growMdArray(layer.Name, options.DryRun) },
+		}}, nil
+	case layerMultipath:
+		name := filepath.Base(path)
+		return []planStep{{
+			Layer:       "multipath",
+			Device:      path,
+			Description: "multipathd resize map",
+			Run:         func() { resizeMultipathMap(name, options.DryRun) },
+		}}, nil
+	case layerMpathPart:
+		return []planStep{{
+			Layer:       "partition",
+			Device:      path,
+			Description: "grow to the end of the disk",
+			Run:         func() { growMultipathPartition(layer.Name, options.DryRun) },
+		}}, nil
+	case layerCrypt:
+		return []planStep{{
+			Layer:       "crypt",
+			Device:      path,
+			Description: "cryptsetup resize",
+			Run:         func() { resizeCryptDevice(layer.Name, options.CryptKeyFile, options.DryRun) },
+		}}, nil
+	case layerLvm:
+		// Extending by a percentage of the free space would leave nothing
+		// for the next logical volume in the volume group to extend into.
+		vg, err := lvmVolumeGroup(layer.Name)
+		if err != nil {
+			return nil, err
+		}
+		if planned["vg:"+vg] && strings.Contains(options.LvmExtend, "%") {
+			return nil, fmt.Errorf("more than one logical volume in %s needs to grow, so --lvm-extend has to be a size like +10G rather than %s", vg, options.LvmExtend)
+		}
+		planned["vg:"+vg] = true
+		steps := []planStep{}
+		for _, slave := range layer.Slaves {
+			if planned["pv:"+slave.Name] {
+				continue
+			}
+			planned["pv:"+slave.Name] = true
+			pv := slave.Path()
+			steps = append(steps, planStep{
+				Layer:       "lvm",
+				Device:      pv,
+				Description: "pvresize",
+				Run:         func() { resizePhysicalVolume(pv, options.DryRun) },
+			})
+		}
+		return append(steps, planStep{
+			Layer:       "lvm",
+			Device:      path,
+			Description: "lvextend " + options.LvmExtend,
+			Run:         func() { extendLogicalVolume(path, options.LvmExtend, options.DryRun) },
+		}), nil
+	}
+	return []planStep{}, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func planStepSummaries(plan resizePlan) []string {
+	summaries := []string{}
+	for _, step := range plan.Steps {
+		summaries = append(summaries, "["+step.Layer+"] "+step.Device+": "+step.Description)
+	}
+	return summaries
+}
+
+func TestBuildResizePlan(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1")
+	addFakeDisk(t, "nvme2n1", "nvme2n1p1")
+	addFakeMdDevice(t, "md0", "raid0", "nvme1n1p1", "nvme2n1p1")
+	addFakeDmDevice(t, "dm-0", "vg-fast", "LVM-abc", "md0")
+	addFakeDmDevice(t, "dm-1", "vg-scratch", "LVM-def", "md0")
+
+	target := resizeTarget{
+		Mount:        "/fast",
+		FSType:       "xfs",
+		Device:       "/dev/mapper/vg-fast",
+		StackDevices: []string{"dm-0"},
+		Devices: []backingDevice{
+			{Ebs: ebsBlockDevice{Device: "/dev/sdf", VolumeID: "vol-1"}, Partition: "/dev/nvme1n1p1"},
+			{Ebs: ebsBlockDevice{Device: "/dev/sdg", VolumeID: "vol-2"}, Partition: "/dev/nvme2n1p1"},
+		},
+	}
+	options := resizeOptions{Growth: growth{Strategy: percentGrowth{Percent: 0.1}}, LvmExtend: "+100%FREE"}
+	planned := map[string]bool{}
+	plan, err := buildResizePlan(target, options, planned)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, planStepSummaries(plan), []string{
+		"[ebs] vol-1, vol-2: grow by 10.00%, all to the same size",
+		"[ebs] /dev/nvme1n1, /dev/nvme2n1: rescan until the kernel sees the new size",
+		"[partition] /dev/nvme1n1p1: grow to the end of the disk",
+		"[partition] /dev/nvme2n1p1: grow to the end of the disk",
+		"[md] /dev/md0: mdadm --grow --size=max",
+		"[lvm] /dev/md0: pvresize",
+		"[lvm] /dev/mapper/vg-fast: lvextend +100%FREE",
+		"[filesystem] /fast: grow xfs",
+	})
+	assert.Equal(t, plan.String(), `Storage stack for /fast (xfs):
+  /dev/mapper/vg-fast (lvm)
+    /dev/md0 (md)
+      /dev/nvme1n1p1 (partition)
+        /dev/nvme1n1 (disk)
+      /dev/nvme2n1p1 (partition)
+        /dev/nvme2n1 (disk)
+Resize plan for /fast:
+  1. [ebs] vol-1, vol-2: grow by 10.00%, all to the same size
+  2. [ebs] /dev/nvme1n1, /dev/nvme2n1: rescan until the kernel sees the new size
+  3. [partition] /dev/nvme1n1p1: grow to the end of the disk
+  4. [partition] /dev/nvme2n1p1: grow to the end of the disk
+  5. [md] /dev/md0: mdadm --grow --size=max
+  6. [lvm] /dev/md0: pvresize
+  7. [lvm] /dev/mapper/vg-fast: lvextend +100%FREE
+  8. [filesystem] /fast: grow xfs`)
+
+	// The first logical volume would take all the free space in the VG,
+	// leaving none for a second one
+	target.Mount = "/scratch"
+	target.Device = "/dev/mapper/vg-scratch"
+	target.StackDevices = []string{"dm-1"}
+	_, err = buildResizePlan(target, options, planned)
+	assert.ErrorContains(t, err, "more than one logical volume in vg needs to grow, so --lvm-extend has to be a size like +10G rather than +100%FREE")
+
+	// With a size both of them get some, and the second only needs extending
+	options.LvmExtend = "+10G"
+	planned = map[string]bool{}
+	target.Mount = "/fast"
+	target.Device = "/dev/mapper/vg-fast"
+	target.StackDevices = []string{"dm-0"}
+	_, err = buildResizePlan(target, options, planned)
+	assert.NilError(t, err)
+	target.Mount = "/scratch"
+	target.Device = "/dev/mapper/vg-scratch"
+	target.StackDevices = []string{"dm-1"}
+	plan, err = buildResizePlan(target, options, planned)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, planStepSummaries(plan), []string{
+		"[lvm] /dev/mapper/vg-scratch: lvextend +10G",
+		"[filesystem] /scratch: grow xfs",
+	})
+}
+
+func TestBuildResizePlanZfsOnCrypt(t *testing.T) {
+	defer useFakeSysfs(t)()
+	defer useFakeCryptsetupStatus("  type:    LUKS2\n  key location: dm-crypt\n")()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1")
+	addFakeDmDevice(t, "dm-0", "crypt-tank", "CRYPT-LUKS2-abc-crypt-tank", "nvme1n1p1")
+
+	target := resizeTarget{
+		Mount:        "/tank",
+		FSType:       "zfs",
+		Pool:         "tank",
+		StackDevices: []string{"dm-0"},
+		Devices: []backingDevice{
+			{Ebs: ebsBlockDevice{Device: "/dev/sdf", VolumeID: "vol-1"}, Partition: "/dev/nvme1n1p1"},
+		},
+	}
+	options := resizeOptions{Growth: growth{Strategy: percentGrowth{Percent: 0.1}}}
+	plan, err := buildResizePlan(target, options, map[string]bool{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, planStepSummaries(plan), []string{
+		"[ebs] vol-1: grow by 10.00%",
+		"[ebs] /dev/nvme1n1: rescan until the kernel sees the new size",
+		"[partition] /dev/nvme1n1p1: grow to the end of the disk",
+		"[crypt] /dev/mapper/crypt-tank: cryptsetup resize",
+		"[filesystem] /tank: grow zfs",
+	})
+
+	// The vdev is the crypt mapping, not the partition under it
+	vdevs := map[string]string{"dm-0": "/dev/mapper/crypt-tank"}
+	found, err := zpoolVdevsFor("tank", vdevs, target.StackDevices)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, found, []string{"/dev/mapper/crypt-tank"})
+	_, err = zpoolVdevsFor("tank", vdevs, []string{"nvme1n1p1"})
+	assert.ErrorContains(t, err, "/dev/nvme1n1p1 doesn't seem to be a vdev of zpool tank")
+}
+
+func TestBuildResizePlanUnsupportedLayer(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1")
+	addFakeDmDevice(t, "dm-0", "sneaky", "", "nvme1n1p1")
+
+	target := resizeTarget{
+		Mount:        "/sneaky",
+		FSType:       "ext4",
+		StackDevices: []string{"dm-0"},
+		Devices: []backingDevice{
+			{Ebs: ebsBlockDevice{Device: "/dev/sdf", VolumeID: "vol-1"}, Partition: "/dev/nvme1n1p1"},
+		},
+	}
+	_, err := buildResizePlan(target, resizeOptions{}, map[string]bool{})
+	assert.ErrorContains(t, err, "/dev/mapper/sneaky is a dm device, which we don't know how to grow")
+}
+
+// Puts a disk image where the plan will look for the disk's device node
+func placeDiskImage(t *testing.T, image *os.File, disk string) {
+	assert.NilError(t, os.MkdirAll(devRoot, 0755))
+	assert.NilError(t, os.Rename(image.Name(), filepath.Join(devRoot, disk)))
+	image.Close()
+}
+
+func TestBuildResizePlanSpillover(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1", "nvme1n1p2")
+	addFakeDmDevice(t, "dm-0", "data--vg-root", "LVM-abc", "nvme1n1p1")
+	// Swap right after the PV, so it can't grow
+	placeDiskImage(t, createGPTImage(t, 16*mib, partitionExtent{Start: 2048, Sectors: 8192}, partitionExtent{Start: 10240, Sectors: 4096}), "nvme1n1")
+
+	target := resizeTarget{
+		Mount:        "/",
+		FSType:       "ext4",
+		Device:       "/dev/mapper/data--vg-root",
+		StackDevices: []string{"dm-0"},
+		Devices: []backingDevice{
+			{Ebs: ebsBlockDevice{Device: "/dev/sdf", VolumeID: "vol-1"}, Partition: "/dev/nvme1n1p1"},
+		},
+	}
+	options := resizeOptions{Growth: growth{Strategy: percentGrowth{Percent: 0.1}}, LvmExtend: "+100%FREE"}
+	_, err := buildResizePlan(target, options, map[string]bool{})
+	assert.ErrorContains(t, err, "can't grow /dev/nvme1n1p1: partition 1 is followed by partition 2, so it can't be grown (--spillover")
+
+	options.Spillover = true
+	plan, err := buildResizePlan(target, options, map[string]bool{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, planStepSummaries(plan), []string{
+		"[ebs] vol-1: grow by 10.00%",
+		"[ebs] /dev/nvme1n1: rescan until the kernel sees the new size",
+		"[partition] /dev/nvme1n1p1: create a new partition after the last one",
+		"[lvm] data-vg: vgextend with the new partition",
+		"[lvm] /dev/nvme1n1p1: pvresize",
+		"[lvm] /dev/mapper/data--vg-root: lvextend +100%FREE",
+		"[filesystem] /: grow ext4",
+	})
+
+	// Caught before anything is grown, rather than once there's space
+	placeDiskImage(t, createMBRImage(t, 16*mib,
+		mbrEntry{Type: 0x8e, FirstLBA: 2048, Sectors: 8192},
+		mbrEntry{Type: 0x82, FirstLBA: 10240, Sectors: 2048},
+		mbrEntry{Type: 0x83, FirstLBA: 12288, Sectors: 2048},
+		mbrEntry{Type: 0x83, FirstLBA: 14336, Sectors: 2048},
+	), "nvme1n1")
+	_, err = buildResizePlan(target, options, map[string]bool{})
+	assert.ErrorContains(t, err, "so it can't be grown (all four primary partitions are already in use)")
+
+	// Nothing to spill over into if ext4 is right on the partition
+	target.StackDevices = []string{"nvme1n1p1"}
+	_, err = buildResizePlan(target, options, map[string]bool{})
+	assert.ErrorContains(t, err, "spilling over only works for LVM physical volumes and btrfs")
+}
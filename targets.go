@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// An EBS volume underneath a filesystem, along with the partition (or
+// whole disk) on it that is the bottom of the filesystem's storage stack.
+// MaxSize is how big (in GiB) the volume can usefully get, 0 for no limit.
+type backingDevice struct {
+	Ebs       ebsBlockDevice
+	Partition string
+	MaxSize   int64
+}
+
+// A mounted filesystem along with every EBS volume underneath it.
+// Most filesystems only have the one, but btrfs, ZFS and LVM can span several.
+type resizeTarget struct {
+	Mount        string
+	FSType       string
+	DeviceNumber string
+	Device       string
+	Pool         string
+	StackDevices []string
+	Devices      []backingDevice
+}
+
+func (t resizeTarget) Partitions() []string {
+	partitions := []string{}
+	for _, device := range t.Devices {
+		partitions = append(partitions, device.Partition)
+	}
+	return partitions
+}
+
+// Returns the kernel names of the block devices a filesystem sits on
+func filesystemDevices(mount mountInfo) []string {
+	switch mount.FSType {
+	case "btrfs":
+		// Btrfs mounts have an anonymous major:minor, so go by its member devices instead
+		return btrfsMemberDevices(kernelNameForSource(mount.Source))
+	case "zfs":
+		devices := []string{}
+		for name := range zpoolVdevs(zfsPoolForDataset(mount.Source)) {
+			devices = append(devices, name)
+		}
+		sort.Strings(devices)
+		return devices
+	}
+	name, err := deviceNameForNumber(mount.DeviceNumber())
+	if err != nil {
+		return []string{}
+	}
+	return []string{name}
+}
+
+// Finds the filesystems that are entirely on EBS
+func findResizeTargets(ebsBlockDevices []ebsBlockDevice) []resizeTarget {
+	ebsDisks := map[string]ebsBlockDevice{}
+	for _, ebsBlockDevice := range ebsBlockDevices {
+		linuxDevice, err := resolveEbsLinuxDevice(ebsBlockDevice)
+		if err != nil {
+			log.Printf("Skipping ebs device %s (%s): %v", ebsBlockDevice.Device, ebsBlockDevice.VolumeID, err)
+			continue
+		}
+		disk, err := diskForBlockDevice(filepath.Base(linuxDevice))
+		if err != nil {
+			log.Printf("Skipping ebs device %s (%s): %v", ebsBlockDevice.Device, ebsBlockDevice.VolumeID, err)
+			continue
+		}
+		ebsDisks[disk] = ebsBlockDevice
+	}
+	return findTargetsOn("EBS volumes", func(disk string) (ebsBlockDevice, bool) {
+		ebs, ok := ebsDisks[disk]
+		return ebs, ok
+	})
+}
+
+// Finds the filesystems that are entirely on SAN LUNs
+func findSanTargets() []resizeTarget {
+	return findTargetsOn("SAN LUNs", func(disk string) (ebsBlockDevice, bool) {
+		return ebsBlockDevice{}, isSanDisk(disk)
+	})
+}
+
+// Walks every mounted filesystem down through its storage stack (LVM and
+// friends) to the disks at the bottom, and keeps the ones where every disk
+// is one we can grow.
+func findTargetsOn(kind string, growable func(disk string) (ebsBlockDevice, bool)) []resizeTarget {
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		log.Fatalf("Couldn't read the mount table: %v", err)
+	}
+	canonical := []mountInfo{}
+	for _, mount := range canonicalMounts(mounts) {
+		if mount.FSType != "zfs" {
+			canonical = append(canonical, mount)
+		}
+	}
+	// Every ZFS dataset is its own mount, but what we resize is the pool
+	for _, mount := range zfsPoolMounts(mounts) {
+		canonical = append(canonical, mount)
+	}
+	sort.Slice(canonical, func(i, j int) bool { return canonical[i].MountPoint < canonical[j].MountPoint })
+
+	targets := []resizeTarget{}
+	for _, mount := range canonical {
+		devices := filesystemDevices(mount)
+		if len(devices) == 0 {
+			// Not worth a word about proc, tmpfs and the like
+			if canResizeFilesystem(mount.FSType) {
+				log.Printf("Skipping %s filesystem on %s, couldn't find the block devices under %s", mount.FSType, mount.MountPoint, mount.Source)
+			}
+			continue
+		}
+		target := resizeTarget{
+			Mount:        mount.MountPoint,
+			FSType:       mount.FSType,
+			DeviceNumber: mount.DeviceNumber(),
+			Device:       devicePath(devices[0]),
+			StackDevices: devices,
+		}
+		if mount.FSType == "zfs" {
+			target.Pool = zfsPoolForDataset(mount.Source)
+		}
+		notGrowable := []string{}
+		for _, device := range devices {
+			for _, leaf := range leafDevices(device) {
+				disk, err := diskForBlockDevice(leaf)
+				if err != nil {
+					notGrowable = append(notGrowable, leaf)
+					continue
+				}
+				ebs, ok := growable(disk)
+				if !ok {
+					notGrowable = append(notGrowable, leaf)
+					continue
+				}
+				target.Devices = append(target.Devices, backingDevice{Ebs: ebs, Partition: "/dev/" + leaf})
+			}
+		}
+		if len(target.Devices) == 0 {
+			continue
+		}
+		if len(notGrowable) > 0 {
+			log.Printf("Skipping %s, it is partly on devices that aren't %s: %v", mount.MountPoint, kind, notGrowable)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func findTargetForPath(path string, targets []resizeTarget) (resizeTarget, error) {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return resizeTarget{}, err
+	}
+	number, err := deviceNumberForPath(realPath)
+	if err != nil {
+		return resizeTarget{}, err
+	}
+	for _, target := range targets {
+		if target.DeviceNumber == number {
+			return target, nil
+		}
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return resizeTarget{}, err
+	}
+	// Every ZFS dataset has its own device number, but they all share the pool
+	for _, mount := range mounts {
+		if mount.DeviceNumber() != number || mount.FSType != "zfs" {
+			continue
+		}
+		for _, target := range targets {
+			if target.Pool == zfsPoolForDataset(mount.Source) {
+				return target, nil
+			}
+		}
+	}
+	// Btrfs subvolumes get their own anonymous device numbers too, but
+	// mountinfo shows the number of the filesystem as a whole.
+	if mount, ok := mountForPath(realPath, mounts); ok && mount.FSType == "btrfs" {
+		for _, target := range targets {
+			if target.DeviceNumber == mount.DeviceNumber() {
+				return target, nil
+			}
+		}
+	}
+	return resizeTarget{}, fmt.Errorf("%s is on device %s, which isn't a mounted EBS volume", path, number)
+}
+
+// The deepest mount the path lives under. Later mounts hide earlier ones
+// on the same mount point.
+func mountForPath(path string, mounts []mountInfo) (mountInfo, bool) {
+	var found mountInfo
+	ok := false
+	for _, mount := range mounts {
+		if isPathUnder(path, mount.MountPoint) && len(mount.MountPoint) >= len(found.MountPoint) {
+			found = mount
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+func isPathUnder(path string, mount string) bool {
+	return mount == "/" || path == mount || strings.HasPrefix(path, mount+"/")
+}
+
+// Narrows the targets down to the filesystems holding the given paths.
+// Every path has to land on an EBS backed filesystem we know about, so a
+// typo doesn't quietly turn into doing nothing.
+func selectTargetsByPath(paths []string, targets []resizeTarget) ([]resizeTarget, error) {
+	selected := []resizeTarget{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		target, err := findTargetForPath(path, targets)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the filesystem for %s: %v", path, err)
+		}
+		log.Printf("%s lives on the %s filesystem mounted at %s (%v)", path, target.FSType, target.Mount, target.Partitions())
+		if !seen[target.Mount] {
+			seen[target.Mount] = true
+			selected = append(selected, target)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func addFakeEbsDisk(t *testing.T, disk string, volumeSerial string, partitions ...string) {
+	addFakeDisk(t, disk, partitions...)
+	writeSysfsFile(t, filepath.Join("block", disk, "device/model"), ebsNvmeModel)
+	writeSysfsFile(t, filepath.Join("block", disk, "device/serial"), volumeSerial)
+}
+
+func useFakeMountInfo(t *testing.T, contents string) func() {
+	oldProcMountInfo := procMountInfo
+	procMountInfo = filepath.Join(filepath.Dir(sysfsRoot), "mountinfo")
+	assert.NilError(t, ioutil.WriteFile(procMountInfo, []byte(contents), 0644))
+	return func() { procMountInfo = oldProcMountInfo }
+}
+
+func TestFindResizeTargets(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeEbsDisk(t, "nvme0n1", "vol0aaaaaaaaaaaaaaaa", "nvme0n1p1")
+	addFakeEbsDisk(t, "nvme1n1", "vol0bbbbbbbbbbbbbbbb")
+	addFakeEbsDisk(t, "nvme2n1", "vol0cccccccccccccccc", "nvme2n1p1")
+	addFakeEbsDisk(t, "nvme3n1", "vol0dddddddddddddddd")
+	addFakeDisk(t, "nvme4n1")
+	addFakeDmDevice(t, "dm-0", "vg-data", "LVM-abc", "nvme2n1p1", "nvme3n1")
+	addFakeDeviceNumber(t, "nvme0n1p1", "259:1")
+	addFakeDeviceNumber(t, "nvme1n1", "259:2")
+	addFakeDeviceNumber(t, "dm-0", "253:0")
+	addFakeDeviceNumber(t, "nvme4n1", "259:6")
+	defer useFakeMountInfo(t, testMountInfo+`50 22 253:0 / /data rw,relatime shared:30 - ext4 /dev/mapper/vg-data rw
+51 22 259:6 / /scratch rw,relatime shared:31 - ext4 /dev/nvme4n1 rw
+`)()
+
+	targets := findResizeTargets([]ebsBlockDevice{
+		{Device: "/dev/xvda", VolumeID: "vol-0aaaaaaaaaaaaaaaa"},
+		{Device: "/dev/sdf", VolumeID: "vol-0bbbbbbbbbbbbbbbb"},
+		{Device: "/dev/sdg", VolumeID: "vol-0cccccccccccccccc"},
+		{Device: "/dev/sdh", VolumeID: "vol-0dddddddddddddddd"},
+	})
+	assert.DeepEqual(t, targets, []resizeTarget{
+		{
+			Mount:        "/",
+			FSType:       "ext4",
+			DeviceNumber: "259:1",
+			Device:       "/dev/nvme0n1p1",
+			StackDevices: []string{"nvme0n1p1"},
+			Devices: []backingDevice{
+				{Ebs: ebsBlockDevice{Device: "/dev/xvda", VolumeID: "vol-0aaaaaaaaaaaaaaaa"}, Partition: "/dev/nvme0n1p1"},
+			},
+		},
+		{
+			Mount:        "/data",
+			FSType:       "ext4",
+			DeviceNumber: "253:0",
+			Device:       "/dev/mapper/vg-data",
+			StackDevices: []string{"dm-0"},
+			Devices: []backingDevice{
+				{Ebs: ebsBlockDevice{Device: "/dev/sdg", VolumeID: "vol-0cccccccccccccccc"}, Partition: "/dev/nvme2n1p1"},
+				{Ebs: ebsBlockDevice{Device: "/dev/sdh", VolumeID: "vol-0dddddddddddddddd"}, Partition: "/dev/nvme3n1"},
+			},
+		},
+		{
+			Mount:        "/var/lib/docker",
+			FSType:       "xfs",
+			DeviceNumber: "259:2",
+			Device:       "/dev/nvme1n1",
+			StackDevices: []string{"nvme1n1"},
+			Devices: []backingDevice{
+				{Ebs: ebsBlockDevice{Device: "/dev/sdf", VolumeID: "vol-0bbbbbbbbbbbbbbbb"}, Partition: "/dev/nvme1n1"},
+			},
+		},
+	})
+}
+
+func TestFindTargetForPath(t *testing.T) {
+	defer useFakeSysfs(t)()
+	dir, err := ioutil.TempDir("", "resize-thyself-path")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	assert.NilError(t, err)
+	number, err := deviceNumberForPath(dir)
+	assert.NilError(t, err)
+
+	defer useFakeMountInfo(t, `22 1 999:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+40 22 `+number+` / `+dir+` rw,relatime shared:20 - ext4 /dev/nvme1n1 rw
+`)()
+	targets := []resizeTarget{
+		{Mount: "/", DeviceNumber: "999:1"},
+		{Mount: dir, DeviceNumber: number},
+		{Mount: "/srv/build", DeviceNumber: "0:45"},
+	}
+	target, err := findTargetForPath(dir, targets)
+	assert.NilError(t, err)
+	assert.Equal(t, target.Mount, dir)
+
+	_, err = findTargetForPath(filepath.Join(dir, "missing"), targets)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Btrfs subvolumes have their own device numbers, so these go by the
+	// number mountinfo has for the mount the path is under
+	targets[1].DeviceNumber = "0:46"
+	useFakeMountInfo(t, `22 1 999:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+40 22 0:45 /@build `+dir+` rw,relatime shared:20 - btrfs /dev/nvme1n1 rw
+`)
+	target, err = findTargetForPath(dir, targets)
+	assert.NilError(t, err)
+	assert.Equal(t, target.Mount, "/srv/build")
+
+	// Anything else that isn't on an EBS volume, like a tmpfs, doesn't
+	// count as being on the root volume just because it's under /
+	useFakeMountInfo(t, `22 1 999:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+40 22 0:50 / `+dir+` rw,relatime shared:20 - tmpfs tmpfs rw
+`)
+	_, err = findTargetForPath(dir, targets[:1])
+	assert.ErrorContains(t, err, "isn't a mounted EBS volume")
+
+	assert.Equal(t, isPathUnder("/srv/build/cache", "/srv/build"), true)
+	assert.Equal(t, isPathUnder("/srv/buildcache", "/srv/build"), false)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// From linux/netlink.h, the kernel's uevents are multicast to group 1
+const netlinkKobjectUevent = 15
+const ueventKernelGroup = 1
+
+// Listens for the uevents the kernel sends out when devices change, so we
+// can get going as soon as a disk grows instead of sleeping and hoping.
+type ueventListener struct {
+	fd int
+}
+
+func newUeventListener() (*ueventListener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkKobjectUevent)
+	if err != nil {
+		return nil, err
+	}
+	address := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventKernelGroup}
+	if err := syscall.Bind(fd, address); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &ueventListener{fd: fd}, nil
+}
+
+// Listening is just a nicety, so if it can't be done we fall back to polling
+func listenForUevents() *ueventListener {
+	listener, err := newUeventListener()
+	if err != nil {
+		log.Printf("Couldn't listen for kernel uevents (%v), polling instead", err)
+		return nil
+	}
+	return listener
+}
+
+func (l *ueventListener) Close() {
+	if l != nil {
+		syscall.Close(l.fd)
+	}
+}
+
+// A uevent is a header like "change@/devices/..." followed by KEY=value
+// pairs, all separated by NULs.
+func parseUevent(message []byte) map[string]string {
+	event := map[string]string{}
+	for _, field := range bytes.Split(message, []byte{0}) {
+		parts := strings.SplitN(string(field), "=", 2)
+		if len(parts) == 2 {
+			event[parts[0]] = parts[1]
+		}
+	}
+	return event
+}
+
+// The kernel sends RESIZE=1 when a disk's capacity changes, older kernels
+// (and some drivers) send DISK_MEDIA_CHANGE=1 instead.
+func isCapacityChangeEvent(event map[string]string, disk string) bool {
+	if event["ACTION"] != "change" || event["SUBSYSTEM"] != "block" {
+		return false
+	}
+	if strings.TrimPrefix(event["DEVNAME"], "/dev/") != disk {
+		return false
+	}
+	return event["RESIZE"] == "1" || event["DISK_MEDIA_CHANGE"] == "1"
+}
+
+// Waits up to timeout for the kernel to say disk has changed size,
+// returning whether it did. Without a listener this is just a sleep.
+func (l *ueventListener) WaitForCapacityChange(disk string, timeout time.Duration) bool {
+	if l == nil {
+		time.Sleep(timeout)
+		return false
+	}
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 64*1024)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(l.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			time.Sleep(remaining)
+			return false
+		}
+		n, _, err := syscall.Recvfrom(l.fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("Couldn't read a kernel uevent: %v", err)
+			time.Sleep(time.Until(deadline))
+			return false
+		}
+		if isCapacityChangeEvent(parseUevent(buf[:n]), disk) {
+			log.Printf("The kernel says %s changed size", disk)
+			return true
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseUevent(t *testing.T) {
+	message := "change@/devices/pci0000:00/0000:00:1f.0/nvme/nvme1/nvme1n1\x00ACTION=change\x00DEVPATH=/devices/pci0000:00/0000:00:1f.0/nvme/nvme1/nvme1n1\x00SUBSYSTEM=block\x00RESIZE=1\x00MAJOR=259\x00MINOR=1\x00DEVNAME=nvme1n1\x00DEVTYPE=disk\x00SEQNUM=4242\x00"
+	event := parseUevent([]byte(message))
+	assert.Equal(t, event["ACTION"], "change")
+	assert.Equal(t, event["DEVNAME"], "nvme1n1")
+	assert.Equal(t, isCapacityChangeEvent(event, "nvme1n1"), true)
+	assert.Equal(t, isCapacityChangeEvent(event, "nvme2n1"), false)
+
+	// Plenty of change events have nothing to do with size
+	delete(event, "RESIZE")
+	assert.Equal(t, isCapacityChangeEvent(event, "nvme1n1"), false)
+	event["DISK_MEDIA_CHANGE"] = "1"
+	assert.Equal(t, isCapacityChangeEvent(event, "nvme1n1"), true)
+	event["SUBSYSTEM"] = "bdi"
+	assert.Equal(t, isCapacityChangeEvent(event, "nvme1n1"), false)
+}
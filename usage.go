@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// How full a filesystem is, straight from statfs(2). Blocks are in units
+// of BlockSize.
+type filesystemUsage struct {
+	BlockSize   uint64
+	TotalBlocks uint64
+	FreeBlocks  uint64
+	AvailBlocks uint64
+	TotalInodes uint64
+	FreeInodes  uint64
+}
+
+// Blocks only root can use, which ext4 reserves 5% of by default
+func (u filesystemUsage) ReservedBlocks() uint64 {
+	if u.AvailBlocks > u.FreeBlocks {
+		return 0
+	}
+	return u.FreeBlocks - u.AvailBlocks
+}
+
+// The fraction of the filesystem that is used. If reservedAsUsed, the
+// root reserved blocks count as used too, since nobody else can have them.
+func (u filesystemUsage) UsedFraction(reservedAsUsed bool) float64 {
+	if u.TotalBlocks == 0 {
+		return 0
+	}
+	free := u.FreeBlocks
+	if reservedAsUsed {
+		free = u.AvailBlocks
+	}
+	return float64(u.TotalBlocks-free) / float64(u.TotalBlocks)
+}
+
+func (u filesystemUsage) FreeBytes(reservedAsUsed bool) uint64 {
+	if reservedAsUsed {
+		return u.AvailBlocks * u.BlockSize
+	}
+	return u.FreeBlocks * u.BlockSize
+}
+
+func (u filesystemUsage) InodesUsedFraction() float64 {
+	if u.TotalInodes == 0 {
+		return 0
+	}
+	return float64(u.TotalInodes-u.FreeInodes) / float64(u.TotalInodes)
+}
+
+// ext4 (and xfs, up to imaxpct) get more inodes in proportion to their
+// size, so getting the used inodes back down to threshold means growing
+// by the same fraction the inode count needs to.
+func inodeGrowthNeeded(usage filesystemUsage, threshold float64) float64 {
+	used := float64(usage.TotalInodes - usage.FreeInodes)
+	return used/(threshold*float64(usage.TotalInodes)) - 1
+}
+
+func usageFromStatfs(stat syscall.Statfs_t) filesystemUsage {
+	blockSize := uint64(stat.Frsize)
+	if blockSize == 0 {
+		blockSize = uint64(stat.Bsize)
+	}
+	return filesystemUsage{
+		BlockSize:   blockSize,
+		TotalBlocks: stat.Blocks,
+		FreeBlocks:  stat.Bfree,
+		AvailBlocks: stat.Bavail,
+		TotalInodes: stat.Files,
+		FreeInodes:  stat.Ffree,
+	}
+}
+
+func statfsUsage(mount string) (filesystemUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mount, &stat); err != nil {
+		return filesystemUsage{}, err
+	}
+	return usageFromStatfs(stat), nil
+}
+
+// When a filesystem is full enough to grow. An Inodes threshold of 0
+// means inodes aren't looked at, as does a MinFree of 0 for free space.
+// Trigger says whether any or all of the space thresholds have to be
+// crossed, inodes running out is always enough by itself.
+type usageThresholds struct {
+	Used           float64
+	Inodes         float64
+	MinFree        uint64
+	TargetFree     uint64
+	Trigger        string
+	ReservedAsUsed bool
+}
+
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1000,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1000 * 1000,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+}
+
+// Parses sizes like 50GiB, 1.5T or 100GB into bytes. Single letter units
+// are binary, like df -h and lvm use them.
+func parseSize(size string) (uint64, error) {
+	size = strings.TrimSpace(size)
+	split := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if split == -1 {
+		split = len(size)
+	}
+	number, err := strconv.ParseFloat(size[:split], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s isn't a size: %v", size, err)
+	}
+	unit := strings.TrimSpace(size[split:])
+	multiplier, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("%s isn't a size, don't know the unit %s", size, unit)
+	}
+	return uint64(number * float64(multiplier)), nil
+}
+
+func formatSize(bytes uint64) string {
+	return fmt.Sprintf("%.2fGiB", float64(bytes)/(1<<30))
+}
+
+// The space half of the thresholds (percent used and free space), for
+// any filesystem that can say how full it is and how much is free. Sizes
+// are in bytes.
+func checkSpaceThresholds(mount string, usedFraction float64, free uint64, total uint64, thresholds usageThresholds) (bool, float64) {
+	growPercent := 0.0
+	log.Printf("%s has a usage of %.2f%%", mount, usedFraction*100)
+	triggered := []bool{usedFraction > thresholds.Used}
+	if triggered[0] {
+		log.Printf("%s is over the space threshold (%.2f%%)", mount, thresholds.Used*100)
+	}
+	if thresholds.MinFree > 0 {
+		log.Printf("%s has %s free", mount, formatSize(free))
+		triggered = append(triggered, free < thresholds.MinFree)
+		if free < thresholds.MinFree {
+			log.Printf("%s has less than the minimum free space (%s)", mount, formatSize(thresholds.MinFree))
+		}
+	}
+	needsResizing := triggered[0]
+	for _, t := range triggered[1:] {
+		if thresholds.Trigger == "all" {
+			needsResizing = needsResizing && t
+		} else {
+			needsResizing = needsResizing || t
+		}
+	}
+	if needsResizing {
+		// Growing should leave at least the target free, or we'd be straight back here
+		target := thresholds.TargetFree
+		if thresholds.MinFree > target {
+			target = thresholds.MinFree
+		}
+		if target > free && total > 0 {
+			growPercent = float64(target-free) / float64(total)
+			log.Printf("%s needs to grow by at least %.2f%% to have %s free", mount, growPercent*100, formatSize(target))
+		}
+	}
+	return needsResizing, growPercent
+}
+
+// Returns whether a filesystem needs to grow, and the least it needs to
+// grow by (as a fraction) to get back under the thresholds, if known.
+func mountNeedsResizing(mount string, thresholds usageThresholds, verbose bool) (bool, float64) {
+	usage, err := statfsUsage(mount)
+	if err != nil {
+		log.Printf("Couldn't get the usage of %s: %v", mount, err)
+		return false, 0
+	}
+	if verbose {
+		log.Printf("%s has %d blocks of %d bytes, %d free, %d available, %d reserved, %d of %d inodes free",
+			mount, usage.TotalBlocks, usage.BlockSize, usage.FreeBlocks, usage.AvailBlocks, usage.ReservedBlocks(), usage.FreeInodes, usage.TotalInodes)
+	}
+	return checkUsageThresholds(mount, usage, thresholds)
+}
+
+func checkUsageThresholds(mount string, usage filesystemUsage, thresholds usageThresholds) (bool, float64) {
+	free := usage.FreeBytes(thresholds.ReservedAsUsed)
+	needsResizing, growPercent := checkSpaceThresholds(mount, usage.UsedFraction(thresholds.ReservedAsUsed), free, usage.TotalBlocks*usage.BlockSize, thresholds)
+	if thresholds.Inodes > 0 && usage.TotalInodes > 0 {
+		inodesUsed := usage.InodesUsedFraction()
+		log.Printf("%s has an inode usage of %.2f%%", mount, inodesUsed*100)
+		if inodesUsed > thresholds.Inodes {
+			inodeGrowth := inodeGrowthNeeded(usage, thresholds.Inodes)
+			log.Printf("%s is over the inode threshold (%.2f%%), it needs to grow by at least %.2f%% for more inodes", mount, thresholds.Inodes*100, inodeGrowth*100)
+			needsResizing = true
+			if inodeGrowth > growPercent {
+				growPercent = inodeGrowth
+			}
+		}
+	}
+	return needsResizing, growPercent
+}
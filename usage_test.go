@@ -0,0 +1,102 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestFilesystemUsage(t *testing.T) {
+	usage := usageFromStatfs(syscall.Statfs_t{Bsize: 4096, Frsize: 4096, Blocks: 1000, Bfree: 200, Bavail: 150, Files: 64, Ffree: 16})
+	assert.Equal(t, usage.BlockSize, uint64(4096))
+	assert.Equal(t, usage.ReservedBlocks(), uint64(50))
+	assert.Equal(t, usage.UsedFraction(false), 0.8)
+	assert.Equal(t, usage.UsedFraction(true), 0.85)
+	assert.Equal(t, usage.TotalInodes, uint64(64))
+	assert.Equal(t, usage.FreeInodes, uint64(16))
+
+	assert.Equal(t, filesystemUsage{}.UsedFraction(true), float64(0))
+}
+
+func TestStatfsUsage(t *testing.T) {
+	usage, err := statfsUsage("/")
+	assert.NilError(t, err)
+	assert.Assert(t, usage.TotalBlocks > 0)
+	assert.Assert(t, usage.BlockSize > 0)
+
+	_, err = statfsUsage("/does/not/exist")
+	assert.Assert(t, err != nil)
+}
+
+func TestCheckUsageThresholds(t *testing.T) {
+	thresholds := usageThresholds{Used: 0.9, Inodes: 0.9}
+	// 40% full, but out of inodes
+	usage := filesystemUsage{BlockSize: 4096, TotalBlocks: 1000, FreeBlocks: 600, AvailBlocks: 550, TotalInodes: 1000, FreeInodes: 10}
+	needsResizing, growPercent := checkUsageThresholds("/cache", usage, thresholds)
+	assert.Equal(t, needsResizing, true)
+	// 990 inodes used needs 1100 inodes to be at 90%
+	assert.Assert(t, growPercent > 0.0999 && growPercent < 0.1001, "grew by %f", growPercent)
+
+	usage.FreeInodes = 500
+	needsResizing, growPercent = checkUsageThresholds("/cache", usage, thresholds)
+	assert.Equal(t, needsResizing, false)
+	assert.Equal(t, growPercent, float64(0))
+
+	// Full of big files, which the usual grow amount takes care of
+	usage.FreeBlocks, usage.AvailBlocks = 50, 0
+	needsResizing, growPercent = checkUsageThresholds("/cache", usage, thresholds)
+	assert.Equal(t, needsResizing, true)
+	assert.Equal(t, growPercent, float64(0))
+
+	// Inodes can be ignored
+	usage = filesystemUsage{TotalBlocks: 1000, FreeBlocks: 600, TotalInodes: 1000, FreeInodes: 10}
+	needsResizing, _ = checkUsageThresholds("/cache", usage, usageThresholds{Used: 0.9})
+	assert.Equal(t, needsResizing, false)
+}
+
+func TestParseSize(t *testing.T) {
+	for size, expected := range map[string]uint64{
+		"50GiB":   50 << 30,
+		"50G":     50 << 30,
+		"50gb":    50 * 1000 * 1000 * 1000,
+		"1.5TiB":  3 << 39,
+		"512 MiB": 512 << 20,
+		"4096":    4096,
+		"10k":     10 << 10,
+	} {
+		actual, err := parseSize(size)
+		assert.NilError(t, err)
+		assert.Equal(t, actual, expected, size)
+	}
+	_, err := parseSize("lots")
+	assert.ErrorContains(t, err, "lots isn't a size")
+	_, err = parseSize("5 parsecs")
+	assert.ErrorContains(t, err, "don't know the unit parsecs")
+}
+
+func TestCheckUsageThresholdsMinFree(t *testing.T) {
+	// A 16TiB filesystem that is 95% full still has 800GiB free
+	usage := filesystemUsage{BlockSize: 4096, TotalBlocks: 4 << 30, FreeBlocks: 4 << 30 / 20, AvailBlocks: 4 << 30 / 20}
+	thresholds := usageThresholds{Used: 0.9, MinFree: 50 << 30, Trigger: "all"}
+	needsResizing, _ := checkUsageThresholds("/big", usage, thresholds)
+	assert.Equal(t, needsResizing, false)
+	thresholds.Trigger = "any"
+	needsResizing, growPercent := checkUsageThresholds("/big", usage, thresholds)
+	assert.Equal(t, needsResizing, true)
+	assert.Equal(t, growPercent, float64(0))
+
+	// A 100GiB filesystem with 20GiB free is fine by percent, but not by min free
+	usage = filesystemUsage{BlockSize: 4096, TotalBlocks: 25 << 20, FreeBlocks: 5 << 20, AvailBlocks: 5 << 20}
+	needsResizing, growPercent = checkUsageThresholds("/small", usage, thresholds)
+	assert.Equal(t, needsResizing, true)
+	// It needs 30GiB more to get to 50GiB free
+	assert.Equal(t, growPercent, 0.3)
+	thresholds.TargetFree = 70 << 30
+	_, growPercent = checkUsageThresholds("/small", usage, thresholds)
+	assert.Equal(t, growPercent, 0.5)
+
+	thresholds.Trigger = "all"
+	needsResizing, _ = checkUsageThresholds("/small", usage, thresholds)
+	assert.Equal(t, needsResizing, false)
+}
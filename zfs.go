@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func zfsPoolForDataset(dataset string) string {
+	return strings.SplitN(dataset, "/", 2)[0]
+}
+
+// Picks one mount to stand for each pool, preferring the pool's own root
+// dataset and otherwise whichever dataset is mounted closest to /.
+func zfsPoolMounts(mounts []mountInfo) map[string]mountInfo {
+	pools := map[string]mountInfo{}
+	for _, mount := range canonicalMounts(mounts) {
+		if mount.FSType != "zfs" {
+			continue
+		}
+		pool := zfsPoolForDataset(mount.Source)
+		current, ok := pools[pool]
+		if !ok || isBetterZfsPoolMount(mount, current, pool) {
+			pools[pool] = mount
+		}
+	}
+	return pools
+}
+
+func isBetterZfsPoolMount(candidate mountInfo, current mountInfo, pool string) bool {
+	if (candidate.Source == pool) != (current.Source == pool) {
+		return candidate.Source == pool
+	}
+	if len(candidate.MountPoint) != len(current.MountPoint) {
+		return len(candidate.MountPoint) < len(current.MountPoint)
+	}
+	return candidate.MountPoint < current.MountPoint
+}
+
+// Pulls the leaf vdev paths out of `zpool status -P`, skipping the log,
+// cache and spare devices which don't add to the pool's capacity.
+func parseZpoolStatusVdevs(output string) []string {
+	vdevs := []string{}
+	inConfig := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if strings.HasPrefix(strings.TrimSpace(line), "config:") {
+			inConfig = true
+			continue
+		}
+		if !inConfig || len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "errors:") {
+			break
+		}
+		switch fields[0] {
+		case "logs", "cache", "spares", "special", "dedup":
+			inConfig = false
+			continue
+		}
+		if strings.HasPrefix(fields[0], "/") {
+			vdevs = append(vdevs, fields[0])
+		}
+	}
+	return vdevs
+}
+
+// Resolves each vdev path (often a /dev/disk/by-id symlink) to the kernel
+// name of the device, keyed by that name.
+func zpoolVdevs(pool string) map[string]string {
+	vdevs := map[string]string{}
+	for _, vdev := range parseZpoolStatusVdevs(safeRun([]string{"zpool", "status", "-P", pool}, false)) {
+		realPath, err := filepath.EvalSymlinks(vdev)
+		if err != nil {
+			log.Printf("Couldn't resolve vdev %s of pool %s: %v", vdev, pool, err)
+			continue
+		}
+		vdevs[filepath.Base(realPath)] = vdev
+	}
+	return vdevs
+}
+
+type zpoolCapacity struct {
+	Size      uint64
+	Allocated uint64
+}
+
+func (c zpoolCapacity) UsedFraction() float64 {
+	return float64(c.Allocated) / float64(c.Size)
+}
+
+// Parses `zpool list -Hp -o size,allocated <pool>`
+func parseZpoolCapacity(output string) (zpoolCapacity, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return zpoolCapacity{}, fmt.Errorf("unexpected zpool list output: %q", output)
+	}
+	size, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return zpoolCapacity{}, err
+	}
+	allocated, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return zpoolCapacity{}, err
+	}
+	if size == 0 {
+		return zpoolCapacity{}, fmt.Errorf("zpool claims to have a size of 0: %q", output)
+	}
+	return zpoolCapacity{Size: size, Allocated: allocated}, nil
+}
+
+// Dataset usage reflects quotas and reservations rather than how much
+// space is left, so for ZFS we go by the capacity of the whole pool.
+func zpoolCapacityOf(pool string) zpoolCapacity {
+	capacity, err := parseZpoolCapacity(safeRun([]string{"zpool", "list", "-Hp", "-o", "size,allocated", pool}, false))
+	if err != nil {
+		log.Panic(err)
+	}
+	return capacity
+}
+
+func zpoolNeedsResizing(pool string, thresholds usageThresholds) (bool, float64) {
+	return checkZpoolThresholds(pool, zpoolCapacityOf(pool), thresholds)
+}
+
+func checkZpoolThresholds(pool string, capacity zpoolCapacity, thresholds usageThresholds) (bool, float64) {
+	var free uint64
+	if capacity.Size > capacity.Allocated {
+		free = capacity.Size - capacity.Allocated
+	}
+	return checkSpaceThresholds("zpool "+pool, capacity.UsedFraction(), free, capacity.Size, thresholds)
+}
+
+func zpoolAutoexpand(pool string) bool {
+	value := safeRun([]string{"zpool", "get", "-Hp", "-o", "value", "autoexpand", pool}, false)
+	return strings.TrimSpace(value) == "on"
+}
+
+// When ZFS is given a whole disk it makes partition 1 for data and a small
+// partition 9 at the end. `zpool online -e` takes care of relabeling those
+// itself, and growpart couldn't grow partition 1 past 9 anyway.
+func isZfsWholeDiskPartition(partition string) bool {
+	name := filepath.Base(partition)
+	number, err := readSysfsString(filepath.Join("class/block", name, "partition"))
+	if err != nil || number != "1" {
+		return false
+	}
+	disk, err := diskForBlockDevice(name)
+	if err != nil {
+		return false
+	}
+	for _, other := range listPartitions(disk) {
+		if number, _ := readSysfsString(filepath.Join("class/block", other, "partition")); number == "9" {
+			return true
+		}
+	}
+	return false
+}
+
+// The vdevs are whatever is at the top of each storage stack (a crypt
+// mapping, say), not the partitions at the bottom, and devices are their
+// kernel names.
+func expandZpool(pool string, devices []string, dryRun bool) {
+	if zpoolAutoexpand(pool) {
+		log.Printf("zpool %s has autoexpand=on, ZFS will expand %v itself", pool, devices)
+		return
+	}
+	vdevs, err := zpoolVdevsFor(pool, zpoolVdevs(pool), devices)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, vdev := range vdevs {
+		safeRun([]string{"zpool", "online", "-e", pool, vdev}, dryRun)
+	}
+}
+
+func zpoolVdevsFor(pool string, vdevs map[string]string, devices []string) ([]string, error) {
+	found := []string{}
+	for _, device := range devices {
+		vdev, ok := vdevs[device]
+		if !ok {
+			return nil, fmt.Errorf("%s doesn't seem to be a vdev of zpool %s: %v", devicePath(device), pool, vdevs)
+		}
+		found = append(found, vdev)
+	}
+	return found, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testZpoolStatus = `  pool: tank
+ state: ONLINE
+  scan: none requested
+config:
+
+	NAME                STATE     READ WRITE CKSUM
+	tank                ONLINE       0     0     0
+	  mirror-0          ONLINE       0     0     0
+	    /dev/nvme1n1p1  ONLINE       0     0     0
+	    /dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0bbbbbbbbbbbbbbbb-part1  ONLINE       0     0     0
+	logs
+	  /dev/nvme3n1      ONLINE       0     0     0
+	cache
+	  /dev/nvme4n1      ONLINE       0     0     0
+
+errors: No known data errors
+`
+
+func TestParseZpoolStatusVdevs(t *testing.T) {
+	assert.DeepEqual(t, parseZpoolStatusVdevs(testZpoolStatus), []string{
+		"/dev/nvme1n1p1",
+		"/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0bbbbbbbbbbbbbbbb-part1",
+	})
+}
+
+func TestParseZpoolCapacity(t *testing.T) {
+	capacity, err := parseZpoolCapacity("10737418240\t9663676416\n")
+	assert.NilError(t, err)
+	assert.Equal(t, capacity, zpoolCapacity{Size: 10737418240, Allocated: 9663676416})
+	assert.Equal(t, capacity.UsedFraction(), 0.9)
+
+	_, err = parseZpoolCapacity("cannot open 'nope': no such pool\n")
+	assert.ErrorContains(t, err, "unexpected zpool list output")
+}
+
+func TestCheckZpoolThresholds(t *testing.T) {
+	// 10GiB with 1GiB free
+	capacity := zpoolCapacity{Size: 10 << 30, Allocated: 9 << 30}
+	needsResizing, growPercent := checkZpoolThresholds("tank", capacity, usageThresholds{Used: 0.95})
+	assert.Equal(t, needsResizing, false)
+	assert.Equal(t, growPercent, float64(0))
+
+	thresholds := usageThresholds{Used: 0.95, MinFree: 2 << 30, TargetFree: 5 << 30, Trigger: "any"}
+	needsResizing, growPercent = checkZpoolThresholds("tank", capacity, thresholds)
+	assert.Equal(t, needsResizing, true)
+	assert.Equal(t, growPercent, 0.4)
+
+	thresholds.Trigger = "all"
+	needsResizing, _ = checkZpoolThresholds("tank", capacity, thresholds)
+	assert.Equal(t, needsResizing, false)
+}
+
+func TestZfsPoolMounts(t *testing.T) {
+	mounts, err := parseMountInfo(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+90 22 0:50 / /var/lib/postgresql rw,noatime shared:40 - zfs tank/postgres rw,xattr,noacl
+91 22 0:51 / /tank rw,noatime shared:41 - zfs tank rw,xattr,noacl
+92 22 0:52 / /srv/scratch rw,noatime shared:42 - zfs scratch/tmp rw,xattr,noacl
+93 22 0:53 / /srv rw,noatime shared:43 - zfs scratch/srv rw,xattr,noacl
+`)
+	assert.NilError(t, err)
+	pools := zfsPoolMounts(mounts)
+	assert.Equal(t, len(pools), 2)
+	assert.Equal(t, pools["tank"].MountPoint, "/tank")
+	assert.Equal(t, pools["scratch"].MountPoint, "/srv")
+}
+
+func TestIsZfsWholeDiskPartition(t *testing.T) {
+	defer useFakeSysfs(t)()
+	addFakeDisk(t, "nvme1n1", "nvme1n1p1", "nvme1n1p9")
+	addFakeDisk(t, "nvme2n1", "nvme2n1p1")
+	writeSysfsFile(t, "class/block/nvme1n1p9/partition", "9")
+
+	assert.Equal(t, isZfsWholeDiskPartition("/dev/nvme1n1p1"), true)
+	assert.Equal(t, isZfsWholeDiskPartition("/dev/nvme2n1p1"), false)
+	assert.Equal(t, isZfsWholeDiskPartition("/dev/nvme1n1"), false)
+}